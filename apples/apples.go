@@ -4,34 +4,61 @@ package apples
 import (
 	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/magical/chat"
+	"github.com/magical/chat/games"
 )
 
+// Game is a game of apples to apples. It implements chat.Handler,
+// and plays by its own rules at a games.Table.
 type Game struct {
-	mu        sync.Mutex
-	green     []*Card // questions
-	red       []*Card // answers
-	ri, gi    int
-	players   []chat.Person
+	// Store, if not nil, is where the game state is saved
+	// after every move so that it can be restored after a restart.
+	Store games.Store
+
+	// Stats, if not nil, is where finished rounds are recorded.
+	Stats StatsStore
+
+	// Identify returns a stable identity for the sender of a message,
+	// used to key stats. By default players are identified by
+	// their account, if they are logged in to one, and otherwise by nick.
+	Identify func(m *chat.Message) string
+
+	// Source, if not nil, is used to shuffle the cards.
+	// See games.Table.
+	Source rand.Source
+
+	// TimeLimit, if positive, limits how long players have to
+	// play their cards. When time runs out, the judge picks
+	// from whatever cards have been played.
+	TimeLimit time.Duration
+
+	once      sync.Once
+	table     *games.Table
+	green     *deck // questions
+	red       *deck // answers
 	hand      map[chat.Person][]*Card
-	state     string      // "", play, judge
-	room      chat.Room   // where is the game
-	mod       chat.Person // who started the game
+	won       map[chat.Person][]*Card
+	rules     map[string]bool
 	judge     chat.Person // who is judging this round
-	plays     map[chat.Person]*Card
+	plays     map[chat.Person][]*Card
 	greenCard *Card        // current green card
 	redCards  []playedCard // played red cards for judging
 }
 
 type playedCard struct {
 	player chat.Person
-	card   *Card
+	cards  []*Card
+}
+
+// name returns the names of the played cards.
+func (pc playedCard) name() string {
+	return strings.Join(cardNames(pc.cards), " + ")
 }
 
 type Card struct {
@@ -39,153 +66,240 @@ type Card struct {
 	Description string
 }
 
-// commands:
-// join - join a new game
-// start - start the game if enough people have joined
-// play n - play a card
-// pick n - same, or choose the winner
+// commands, besides the ones every games.Table has:
+// play n - play a card (play n m when playing two)
+// pick n - choose the winner
 // list - show cards over pm
+// stats [nick] - show someone's stats
+// leaderboard [daily|weekly|monthly|all] - show who has won the most
+// variant name [on|off] - moderator enables a house rule before start
+// skip - moderator throws out the green card and deals another
+// setjudge nick - moderator makes someone else the judge
 
+const minPlayers = 3
+
+// Table returns the table the game is played at.
+// The table is made the first time it is needed, from Store, Identify
+// and Source, so they must be set before the game is first used.
+func (g *Game) Table() *games.Table {
+	g.once.Do(func() {
+		g.table = &games.Table{
+			Rules:      g,
+			Store:      g.Store,
+			MinPlayers: minPlayers,
+			Identify:   g.Identify,
+			Source:     g.Source,
+		}
+	})
+	return g.table
+}
+
+// Event implements chat.Handler.
 func (g *Game) Event(b *chat.Bot, m *chat.Message) {
-	log.Println("event?")
-	if !directed(m) {
-		log.Println("not directed")
-		return
-	}
-	g.mu.Lock()
-	defer g.mu.Unlock()
-	if g.room == "" || m.Room == g.room {
-		text := strings.TrimPrefix(m.Text, "magicalbot: ")
-		if text == "start" {
-			log.Println("start")
-			g.start(b, m)
-			return
-		} else if text == "join" {
-			log.Println("join")
-			g.join(b, m, m.From)
-			return
-		} else if strings.HasPrefix(text, "pick ") {
-			log.Println("pick")
-			arg := strings.TrimPrefix(text, "pick ")
-			index, err := strconv.ParseInt(arg, 10, 0)
-			if err != nil {
-				b.Respond(m, "invalid number")
-			}
-			err = g.pick(b, m.From, int(index))
-			if err != nil {
-				b.Respond(m, err.Error())
-			}
+	g.Table().Event(b, m)
+}
+
+// Restore loads the game from g.Store. See games.Table.Restore.
+func (g *Game) Restore() error {
+	return g.Table().Restore()
+}
+
+// Command implements games.Rules.
+func (g *Game) Command(t *games.Table, m *chat.Message, cmd, arg string) error {
+	switch cmd {
+	case "list":
+		return g.list(t, m.From)
+	case "play":
+		if m.Room != "" {
+			return errors.New("play your cards privately: /msg magicalbot play [n]")
 		}
-		// room stuff
-	} else if g.playing(m.From) {
-		// player stuff
-		if m.Text == "list" {
-			log.Println("list")
-			err := g.list(b, m.From)
-			if err != nil {
-				b.Respond(m, err.Error())
-			}
-		} else if strings.HasPrefix(m.Text, "play ") {
-			log.Println("play")
-			arg := strings.TrimPrefix(m.Text, "play ")
+		var indexes []int
+		for _, arg := range strings.Fields(arg) {
 			index, err := strconv.ParseInt(arg, 10, 0)
 			if err != nil {
-				b.Respond(m, "invalid number")
+				return errors.New("invalid number")
 			}
-			err = g.play(b, m.From, int(index))
-			if err != nil {
-				b.Respond(m, err.Error())
+			indexes = append(indexes, int(index))
+		}
+		return g.play(t, m.From, indexes...)
+	case "pick":
+		if g.rules[privateJudging] && m.Room != "" {
+			return errors.New("pick privately: /msg magicalbot pick [n]")
+		}
+		index, err := strconv.ParseInt(arg, 10, 0)
+		if err != nil {
+			return errors.New("invalid number")
+		}
+		return g.pick(t, m.From, int(index))
+	case "variant":
+		args := strings.Fields(arg)
+		if len(args) == 0 {
+			on := g.enabledVariants()
+			if len(on) == 0 {
+				on = []string{"none"}
 			}
-			return
+			t.Reply(m, fmt.Sprintf("variants: %s; enabled: %s", strings.Join(allVariants(), ", "), strings.Join(on, ", ")))
+			return nil
 		}
-	}
-}
-
-// Directed reports whether a message is directed at the bot
-func directed(m *chat.Message) bool {
-	return m.Room == "" || strings.HasPrefix(m.Text, "magicalbot:") // lol
+		on := len(args) < 2 || args[1] != "off"
+		return g.variant(t, m, args[0], on)
+	case "skip", "setjudge":
+		return g.moderate(t, m, cmd, arg)
+	case "stats":
+		return g.stats(t, m, arg)
+	case "leaderboard":
+		return g.leaderboard(t, m, arg)
+	}
+	return games.ErrUnknownCommand
 }
 
-// playing reports whether p is part of the current game
-func (g *Game) playing(p chat.Person) bool {
-	for _, q := range g.players {
-		if p == q {
-			return true
-		}
-	}
-	return false
+// Start implements games.Rules.
+func (g *Game) Start(t *games.Table) error {
+	g.init()
+	g.judge = t.Players()[0]
+	g.shuffle(t.Rand())
+	g.startRound(t)
+	return nil
 }
 
-func (g *Game) join(b *chat.Bot, m *chat.Message, p chat.Person) {
-	if g.state != "" {
-		b.Respond(m, "a game is already in progress")
-		return
+// startRound deals a new green card and tops up everyone's hand.
+// If there aren't enough cards left to play another round, the game ends.
+func (g *Game) startRound(t *games.Table) {
+	for _, p := range t.Admit() {
+		t.Announce(fmt.Sprintf("%s joins the game", p))
 	}
-	if g.playing(p) {
-		b.Respond(m, "you are already playing")
-		return
+	for p := range g.plays {
+		delete(g.plays, p)
 	}
-	g.players = append(g.players, p)
-	b.Respond(m, "okay")
-}
-
-const minPlayers = 3
-
-func (g *Game) start(b *chat.Bot, m *chat.Message) {
-	if g.state != "" {
-		b.Respond(m, "a game is already in progress")
+	if !g.dealGreen() {
+		t.Announce("the green deck is empty!")
+		t.End()
 		return
 	}
-	if len(g.players) < minPlayers {
-		b.Respond(m, "need more players")
-		return
+	for _, p := range t.Players() {
+		g.deal(p)
 	}
-	g.init()
-	g.state = "play"
-	lastJudge := -1
-	for i, p := range g.players {
-		if p == g.judge {
-			lastJudge = i
-			break
+	for _, p := range t.Players() {
+		if p != g.judge && len(g.hand[p]) < g.cardsPerPlay() {
+			t.Announce("the red deck is empty!")
+			t.End()
+			return
 		}
 	}
-	if lastJudge < 0 {
-		g.judge = g.players[(lastJudge+1)%len(g.players)]
+	t.SetPhase("play", g.TimeLimit)
+	for _, p := range t.Players() {
+		g.list(t, p)
 	}
-	g.mod = g.players[0]
-	g.room = m.Room
-	g.shuffle()
-	for _, p := range g.players {
-		g.deal(p)
+	t.Announce(fmt.Sprintf("%s is judging", g.judge))
+	if g.rules[appleTurnovers] {
+		t.Announce("the green card will be revealed after everyone has played")
+	} else {
+		g.announceGreen(t)
 	}
-	for _, p := range g.players {
-		g.list(b, p)
+	if g.cardsPerPlay() > 1 {
+		t.Announce(fmt.Sprintf("play %d cards each", g.cardsPerPlay()))
 	}
-	g.dealGreen()
-	g.announce(b, fmt.Sprintf("%s is judging", g.judge))
-	g.announce(b, fmt.Sprintf("the green card is %s", g.greenCard.Name))
-	for p := range g.plays {
+}
+
+// announceGreen announces the green card for this round.
+func (g *Game) announceGreen(t *games.Table) {
+	if g.rules[crabApples] {
+		t.Announce(fmt.Sprintf("the green card is %s, but play the least %s card you have", chat.Bold(g.greenCard.Name), g.greenCard.Name))
+	} else {
+		t.Announce(fmt.Sprintf("the green card is %s", chat.Bold(g.greenCard.Name)))
+	}
+}
+
+// Stop implements games.Rules. It announces the scores
+// and returns all the cards to the decks.
+func (g *Game) Stop(t *games.Table) {
+	t.Announce("game over!")
+	t.Announce(g.scores(t))
+	g.green.Discard(g.greenCard)
+	g.greenCard = nil
+	for p, cards := range g.plays {
+		g.red.Discard(cards...)
 		delete(g.plays, p)
 	}
+	for p, hand := range g.hand {
+		g.red.Discard(hand...)
+		delete(g.hand, p)
+	}
+	for p, cards := range g.won {
+		g.green.Discard(cards...)
+		delete(g.won, p)
+	}
+	g.redCards = g.redCards[:0]
 }
 
-func (g *Game) shuffle() {
-	if g.red == nil {
-		g.red = make([]*Card, len(redCards))
-		copy(g.red, redCards)
+// scores returns a summary of how many green cards each player has won.
+func (g *Game) scores(t *games.Table) string {
+	var s []string
+	for _, p := range t.Players() {
+		s = append(s, fmt.Sprintf("%s: %s", p, chat.Bold(strconv.Itoa(len(g.won[p])))))
 	}
-	if g.green == nil {
-		g.green = make([]*Card, len(greenCards))
-		copy(g.green, greenCards)
+	return "scores: " + strings.Join(s, ", ")
+}
+
+// Leave implements games.Rules. The player's cards go back to the decks.
+// If they were judging, the round is thrown out
+// and the next player judges a new one. So is a round left
+// with no cards to judge.
+func (g *Game) Leave(t *games.Table, p chat.Person) {
+	g.red.Discard(g.hand[p]...)
+	delete(g.hand, p)
+	g.red.Discard(g.plays[p]...)
+	delete(g.plays, p)
+	g.green.Discard(g.won[p]...)
+	delete(g.won, p)
+
+	switch {
+	case p == g.judge:
+		g.judge = t.NextPlayer(p)
+		t.Announce("the judge left, so this round is cancelled")
+		g.cancelPlays()
+		g.green.Discard(g.greenCard)
+		g.greenCard = nil
+		g.startRound(t)
+	case t.Phase() == "play":
+		if g.everybodyPlayed(t) {
+			g.startJudging(t)
+		}
+	case t.Phase() == "judge":
+		for i, pc := range g.redCards {
+			if pc.player == p {
+				g.redCards = append(g.redCards[:i], g.redCards[i+1:]...)
+				break
+			}
+		}
+		if len(g.redCards) == 0 {
+			t.Announce("there are no cards left to judge, so this round is cancelled")
+			g.green.Discard(g.greenCard)
+			g.greenCard = nil
+			g.startRound(t)
+			return
+		}
+		g.announceJudging(t)
 	}
-	shuffleCards(g.green)
-	shuffleCards(g.red)
-	g.ri = 0
-	g.gi = 0
 }
-func shuffleCards(cards []*Card) {
+
+// cancelPlays returns any cards played this round to their owners' hands.
+func (g *Game) cancelPlays() {
+	for p, cards := range g.plays {
+		g.hand[p] = append(g.hand[p], cards...)
+		delete(g.plays, p)
+	}
+	g.redCards = g.redCards[:0]
+}
+
+func (g *Game) shuffle(r *rand.Rand) {
+	g.red = newDeck(r, redCards)
+	g.green = newDeck(r, greenCards)
+}
+
+func shuffleCards(r *rand.Rand, cards []*Card) {
 	for i := range cards {
-		j := i + rand.Intn(len(cards)-i)
+		j := i + r.Intn(len(cards)-i)
 		if i != j {
 			cards[i], cards[j] = cards[j], cards[i]
 		}
@@ -199,101 +313,207 @@ func (g *Game) init() {
 		g.hand = make(map[chat.Person][]*Card)
 	}
 	if g.plays == nil {
-		g.plays = make(map[chat.Person]*Card)
+		g.plays = make(map[chat.Person][]*Card)
+	}
+	if g.won == nil {
+		g.won = make(map[chat.Person][]*Card)
 	}
 }
 
+// deal fills p's hand up to handSize, or until the red deck runs out.
 func (g *Game) deal(p chat.Person) {
-	if g.hand == nil {
-		g.hand = make(map[chat.Person][]*Card)
-	}
 	hand := g.hand[p]
 	for len(hand) < handSize {
-		if g.ri < len(g.red) {
-			card := g.red[g.ri]
-			g.ri++
-			hand = append(hand, card)
+		card, ok := g.red.Draw()
+		if !ok {
+			break
 		}
+		hand = append(hand, card)
 	}
 	g.hand[p] = hand
 }
 
-func (g *Game) dealGreen() {
-	if g.gi < len(g.green) {
-		g.greenCard = g.green[0]
-		g.gi++
-	}
+// dealGreen draws the next green card.
+// It reports false if the green deck is empty.
+func (g *Game) dealGreen() bool {
+	card, ok := g.green.Draw()
+	if !ok {
+		return false
+	}
+	g.greenCard = card
+	return true
 }
 
-func (g *Game) list(b *chat.Bot, p chat.Person) error {
-	if !g.playing(p) {
+func (g *Game) list(t *games.Table, p chat.Person) error {
+	if !t.Playing(p) {
 		return errors.New("you aren't playing")
 	}
-	b.Send(p, "Your hand is:")
+	t.Notice(p, "Your hand is:")
 	for i, c := range g.hand[p] {
-		b.Send(p, fmt.Sprintf("%d: %s", i, c.Name))
+		t.Notice(p, fmt.Sprintf("%d: %s", i, c.Name))
 	}
 	return nil
 }
 
-func (g *Game) play(b *chat.Bot, p chat.Person, index int) error {
-	if !g.playing(p) {
+// play plays the cards at the given indexes in p's hand.
+// If p had already played this round, those cards go back in their hand.
+func (g *Game) play(t *games.Table, p chat.Person, indexes ...int) error {
+	if !t.Playing(p) {
 		return errors.New("you aren't playing")
 	}
-	if g.state != "play" {
+	if t.Phase() != "play" {
 		return errors.New("it isn't time to do that")
 	}
+	if t.Paused() {
+		return errors.New("the game is paused")
+	}
 	if g.judge == p {
 		return errors.New("you are judging!")
 	}
+	if n := g.cardsPerPlay(); len(indexes) != n {
+		if n == 1 {
+			return errors.New("play one card")
+		}
+		return fmt.Errorf("play %d cards", n)
+	}
 	hand := g.hand[p]
-	if !(0 <= index && index < len(hand)) {
-		return errors.New("no such card")
+	seen := make(map[int]bool)
+	for _, index := range indexes {
+		if !(0 <= index && index < len(hand)) {
+			return errors.New("no such card")
+		}
+		if seen[index] {
+			return errors.New("you can't play the same card twice")
+		}
+		seen[index] = true
+	}
+	var cards []*Card
+	for _, index := range indexes {
+		cards = append(cards, hand[index])
 	}
-	if c, ok := g.plays[p]; ok {
-		// if card played previously, put back in hand
-		hand = append(hand, c)
+	var rest []*Card
+	for i, c := range hand {
+		if !seen[i] {
+			rest = append(rest, c)
+		}
 	}
-	g.plays[p] = hand[index]
-	g.hand[p] = append(hand[:index], hand[index+1:]...)
+	// if cards played previously, put back in hand
+	_, replayed := g.plays[p]
+	rest = append(rest, g.plays[p]...)
+	g.plays[p] = cards
+	g.hand[p] = rest
 	// has everybody played?
-	if g.everybodyPlayed() {
-		g.startJudging(b)
+	if g.everybodyPlayed(t) {
+		g.startJudging(t)
+	} else if !replayed {
+		t.Announce(g.progress(t))
 	}
 	return nil
 }
 
-func (g *Game) everybodyPlayed() bool {
-	for _, p := range g.players {
-		if p == g.judge {
-			continue
-		}
-		if _, ok := g.plays[p]; !ok {
-			return false
+// waitingOn returns the players who haven't played yet this round.
+func (g *Game) waitingOn(t *games.Table) []chat.Person {
+	var waiting []chat.Person
+	for _, p := range t.Players() {
+		if _, ok := g.plays[p]; !ok && p != g.judge {
+			waiting = append(waiting, p)
 		}
 	}
-	return true
+	return waiting
+}
+
+// progress returns a summary of how many players have played.
+func (g *Game) progress(t *games.Table) string {
+	waiting := g.waitingOn(t)
+	n := len(t.Players()) - 1
+	return fmt.Sprintf("%d/%d played, waiting on %s", n-len(waiting), n, games.Names(waiting))
+}
+
+// Status implements games.Rules.
+func (g *Game) Status(t *games.Table) string {
+	if t.Phase() == "judge" {
+		return fmt.Sprintf("everybody has played, waiting on %s to pick", g.judge)
+	}
+	return g.progress(t)
+}
+
+func (g *Game) everybodyPlayed(t *games.Table) bool {
+	return len(g.waitingOn(t)) == 0
+}
+
+// Timeout implements games.Rules. When time runs out for playing cards,
+// the judge picks from the cards that have been played, if any.
+func (g *Game) Timeout(t *games.Table, phase string) {
+	if phase != "play" {
+		return
+	}
+	t.Announce(fmt.Sprintf("time's up! no cards from %s", games.Names(g.waitingOn(t))))
+	if len(g.plays) == 0 {
+		g.cancelPlays()
+		g.green.Discard(g.greenCard)
+		g.greenCard = nil
+		g.startRound(t)
+		return
+	}
+	g.startJudging(t)
 }
 
-func (g *Game) startJudging(b *chat.Bot) {
-	g.announce(b, "everybody has played!")
+// Resume implements games.Rules.
+func (g *Game) Resume(t *games.Table) {
+	t.Announce(fmt.Sprintf("%s is judging", g.judge))
+	if !g.rules[appleTurnovers] {
+		g.announceGreen(t)
+	}
+	if t.Phase() == "judge" {
+		g.announceJudging(t)
+	}
+}
+
+func (g *Game) startJudging(t *games.Table) {
+	if len(g.waitingOn(t)) == 0 {
+		t.Announce("everybody has played!")
+	}
 	if g.redCards != nil {
 		g.redCards = g.redCards[:0]
 	}
-	for p, c := range g.plays {
-		g.redCards = append(g.redCards, playedCard{p, c})
+	// go in player order rather than map order,
+	// so that the shuffle only depends on the table's source
+	for _, p := range t.Players() {
+		if cards, ok := g.plays[p]; ok {
+			g.redCards = append(g.redCards, playedCard{p, cards})
+		}
 	}
-	shufflePlayedCards(g.redCards)
+	shufflePlayedCards(t.Rand(), g.redCards)
+	t.SetPhase("judge", 0)
+	g.announceJudging(t)
+}
+
+// announceJudging shows the played cards and asks the judge to pick one.
+func (g *Game) announceJudging(t *games.Table) {
 	for i, pc := range g.redCards {
-		g.announce(b, fmt.Sprintf("%d: %s", i, pc.card.Name))
+		t.Announce(fmt.Sprintf("%d: %s", i, pc.name()))
+	}
+	if g.rules[appleTurnovers] {
+		g.announceGreen(t)
+	}
+	how := "say pick [n]"
+	if g.rules[privateJudging] {
+		how = "message me pick [n]"
+		t.Notice(g.judge, "The cards are:")
+		for i, pc := range g.redCards {
+			t.Notice(g.judge, fmt.Sprintf("%d: %s", i, pc.name()))
+		}
+	}
+	if g.rules[crabApples] {
+		t.Announce(fmt.Sprintf("%s: choose the least appropriate card and %s", g.judge, how))
+	} else {
+		t.Announce(fmt.Sprintf("%s: choose the most appropriate card and %s", g.judge, how))
 	}
-	g.state = "judge"
-	g.announce(b, fmt.Sprintf("%s: choose the most appropriate card and say pick [n]", g.judge))
 }
 
-func shufflePlayedCards(cards []playedCard) {
+func shufflePlayedCards(r *rand.Rand, cards []playedCard) {
 	for i := range cards {
-		j := i + rand.Intn(len(cards)-i)
+		j := i + r.Intn(len(cards)-i)
 		if i != j {
 			cards[i], cards[j] = cards[j], cards[i]
 		}
@@ -301,22 +521,35 @@ func shufflePlayedCards(cards []playedCard) {
 }
 
 // pick a winner
-func (g *Game) pick(b *chat.Bot, p chat.Person, index int) error {
-	if !g.playing(p) {
+func (g *Game) pick(t *games.Table, p chat.Person, index int) error {
+	if !t.Playing(p) {
 		return errors.New("you aren't playing")
 	}
-	if g.state != "judge" {
+	if t.Phase() != "judge" || p != g.judge {
 		return errors.New("you aren't the judge")
 	}
+	if t.Paused() {
+		return errors.New("the game is paused")
+	}
 	if !(0 <= index && index < len(g.redCards)) {
 		return errors.New("invalid index")
 	}
 	winner := g.redCards[index].player
-	g.announce(b, string(winner)+" wins!")
-	g.state = ""
+	t.Announce(fmt.Sprintf("%s wins with %s!", winner, chat.Bold(g.redCards[index].name())))
+	var reveal []string
+	for _, pc := range g.redCards {
+		reveal = append(reveal, fmt.Sprintf("%s played %s", pc.player, pc.name()))
+	}
+	t.Announce(strings.Join(reveal, "; "))
+	g.record(t, g.redCards[index])
+	g.won[winner] = append(g.won[winner], g.greenCard)
+	g.greenCard = nil
+	for _, pc := range g.redCards {
+		g.red.Discard(pc.cards...)
+		delete(g.plays, pc.player)
+	}
+	g.redCards = g.redCards[:0]
+	g.judge = t.NextPlayer(g.judge)
+	g.startRound(t)
 	return nil
 }
-
-func (g *Game) announce(b *chat.Bot, message string) {
-	b.SendRoom(g.room, message)
-}
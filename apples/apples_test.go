@@ -3,7 +3,11 @@ package apples
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/magical/chat"
 )
 
 func TestShuffleCards(t *testing.T) {
@@ -11,7 +15,7 @@ func TestShuffleCards(t *testing.T) {
 	// tended to sort later cards towards the front,
 	// and almost always placed the last card first.
 
-	rand.Seed(0)
+	r := rand.New(rand.NewSource(0))
 
 	// Initialize cards numbered 0 to 99
 	var cards []*Card
@@ -20,10 +24,194 @@ func TestShuffleCards(t *testing.T) {
 	}
 
 	// Shuffle
-	shuffleCards(cards)
+	shuffleCards(r, cards)
 
 	// Is 99 first?
 	if cards[0].Name == "99" {
 		t.Errorf("shuffleCards seems biased: first card is 99, expected any other number")
 	}
 }
+
+func TestJoinAndLeaveMidGame(t *testing.T) {
+	g, b, conn := startVariant(t)
+	say := func(from chat.Person, text string) {
+		g.Event(b, &chat.Message{Conn: conn, From: from, Room: "#apples", Text: "magicalbot: " + text})
+	}
+
+	say("dave", "join")
+	if g.table.Playing("dave") || !conn.Said("dave", "you will join next round") {
+		t.Fatalf("dave should be waiting for the next round")
+	}
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			g.play(g.table, p, 0)
+		}
+	}
+	g.pick(g.table, g.judge, 0)
+	if !g.table.Playing("dave") || len(g.hand["dave"]) != handSize {
+		t.Fatalf("dave wasn't dealt in at the start of the round")
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// bob is judging; if he leaves, carol judges a new round
+	if g.judge != "bob" {
+		t.Fatalf("judge = %s, want bob", g.judge)
+	}
+	g.play(g.table, "carol", 0)
+	say("bob", "leave")
+	if g.table.Playing("bob") || g.judge != "carol" || g.table.Phase() != "play" {
+		t.Errorf("after judge left: judge = %s, state = %s", g.judge, g.table.Phase())
+	}
+	if len(g.plays) != 0 || len(g.hand["carol"]) != handSize {
+		t.Errorf("cards played in the cancelled round weren't returned")
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the moderator can kick
+	say("dave", "kick alice")
+	if !g.table.Playing("alice") {
+		t.Errorf("dave kicked alice, but isn't the moderator")
+	}
+	// once someone parts, everyone else has played
+	g.play(g.table, "alice", 0)
+	g.Event(b, &chat.Message{Conn: conn, Kind: chat.KindPart, From: "dave", Room: "#apples"})
+	if g.table.Phase() != "" {
+		t.Errorf("game should end when too few players are left")
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModeratorCommands(t *testing.T) {
+	g, b, conn := startVariant(t)
+	say := func(from chat.Person, text string) {
+		g.Event(b, &chat.Message{Conn: conn, From: from, Room: "#apples", Text: "magicalbot: " + text})
+	}
+
+	say("bob", "pause")
+	if g.table.Paused() || !conn.Said("bob", "only the moderator") {
+		t.Errorf("bob paused the game, but alice is the moderator")
+	}
+	say("alice", "pause")
+	if err := g.play(g.table, "bob", 0); err == nil {
+		t.Errorf("played a card while the game was paused")
+	}
+	say("alice", "resume")
+	if err := g.play(g.table, "bob", 0); err != nil {
+		t.Errorf("couldn't play after resuming: %v", err)
+	}
+
+	green := g.greenCard
+	say("alice", "skip")
+	if g.greenCard == green || len(g.plays) != 0 {
+		t.Errorf("skip didn't deal a new green card and return the played cards")
+	}
+
+	say("alice", "setjudge carol")
+	if g.judge != "carol" || g.table.Phase() != "play" {
+		t.Errorf("judge = %s, want carol", g.judge)
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Fatal(err)
+	}
+
+	say("alice", "leave")
+	if g.table.Mod() != "bob" {
+		t.Errorf("mod = %q after alice left, want bob", g.table.Mod())
+	}
+	say("dave", "join")
+	say("bob", "abort")
+	if g.table.Phase() != "" || !conn.Said("#apples", "scores:") {
+		t.Errorf("abort didn't end the game and announce the scores")
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeededDeal(t *testing.T) {
+	g, b, conn := newTestGame("alice", "bob", "carol")
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+	if g.greenCard.Name != "Busy" {
+		t.Errorf("green card is %q, want Busy", g.greenCard.Name)
+	}
+	want := []string{"Saturn", "Martin Luther King, Jr.", "Bird Watching"}
+	for i, c := range g.hand["bob"][:len(want)] {
+		if c.Name != want[i] {
+			t.Errorf("bob's card %d is %q, want %q", i, c.Name, want[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	// Two games with the same seed and the same moves
+	// should say exactly the same things.
+	var transcripts [2][]string
+	for i := range transcripts {
+		g, b, conn := setupGame(&Game{Source: rand.NewSource(42)}, "alice", "bob", "carol")
+		g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+		for round := 0; round < 20; round++ {
+			for _, p := range g.table.Players() {
+				if p != g.judge {
+					g.play(g.table, p, round%handSize)
+				}
+			}
+			g.pick(g.table, g.judge, 1)
+		}
+		transcripts[i] = conn.Sent
+	}
+	if !reflect.DeepEqual(transcripts[0], transcripts[1]) {
+		t.Errorf("replayed game differs from the original")
+	}
+}
+
+func TestTimeLimit(t *testing.T) {
+	g, b, conn := setupGame(&Game{Source: rand.NewSource(1), TimeLimit: time.Minute}, "alice", "bob", "carol")
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+	green := g.greenCard
+
+	// nobody played, so the round is thrown out
+	g.table.Expire()
+	if g.greenCard == green || g.table.Phase() != "play" || !conn.Said("#apples", "time's up") {
+		t.Fatalf("a round with no plays wasn't replaced: %q", conn.Sent)
+	}
+
+	// the judge picks from whatever was played in time
+	g.Event(b, &chat.Message{Conn: conn, From: "carol", Text: "play 0"})
+	g.table.Expire()
+	if g.table.Phase() != "judge" || len(g.redCards) != 1 || g.redCards[0].player != "carol" {
+		t.Fatalf("phase = %q, cards = %v; want judging carol's card", g.table.Phase(), g.redCards)
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJudgingNothing(t *testing.T) {
+	g, b, conn := setupGame(&Game{Source: rand.NewSource(1), TimeLimit: time.Minute}, "alice", "bob", "carol", "dave")
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+	var player chat.Person
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			player = p
+			break
+		}
+	}
+	g.Event(b, &chat.Message{Conn: conn, From: player, Text: "play 0"})
+	g.table.Expire()
+	green := g.greenCard
+
+	// the only card played leaves with its player
+	g.Event(b, &chat.Message{Conn: conn, Kind: chat.KindPart, From: player, Room: "#apples"})
+	if g.table.Phase() != "play" || g.greenCard == green || !conn.Said("#apples", "no cards left to judge") {
+		t.Fatalf("phase = %q after the only played card left: %q", g.table.Phase(), conn.Sent)
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,59 @@
+package apples
+
+import "math/rand"
+
+// A deck is a draw pile plus a discard pile.
+// When the draw pile runs out, the discards are shuffled
+// to form a new draw pile.
+type deck struct {
+	draw    []*Card
+	discard []*Card
+	rand    *rand.Rand
+}
+
+// newDeck returns a deck containing a copy of cards, shuffled using r.
+func newDeck(r *rand.Rand, cards []*Card) *deck {
+	d := &deck{draw: make([]*Card, len(cards)), rand: r}
+	copy(d.draw, cards)
+	shuffleCards(r, d.draw)
+	return d
+}
+
+// Draw removes the top card from the deck.
+// It reports false if there are no cards left in either pile.
+func (d *deck) Draw() (*Card, bool) {
+	if len(d.draw) == 0 {
+		d.reshuffle()
+	}
+	if len(d.draw) == 0 {
+		return nil, false
+	}
+	c := d.draw[len(d.draw)-1]
+	d.draw[len(d.draw)-1] = nil
+	d.draw = d.draw[:len(d.draw)-1]
+	return c, true
+}
+
+// Discard puts cards on the discard pile.
+func (d *deck) Discard(cards ...*Card) {
+	for _, c := range cards {
+		if c != nil {
+			d.discard = append(d.discard, c)
+		}
+	}
+}
+
+// Len returns the number of cards left in the deck, including discards.
+func (d *deck) Len() int {
+	return len(d.draw) + len(d.discard)
+}
+
+// reshuffle moves the discard pile underneath the draw pile and shuffles it.
+func (d *deck) reshuffle() {
+	if len(d.discard) == 0 {
+		return
+	}
+	shuffleCards(d.rand, d.discard)
+	d.draw = append(d.discard, d.draw...)
+	d.discard = nil
+}
@@ -0,0 +1,172 @@
+package apples
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"testing/quick"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/internal/chattest"
+)
+
+func testCards(n int) []*Card {
+	var cards []*Card
+	for i := 0; i < n; i++ {
+		cards = append(cards, &Card{Name: fmt.Sprint(i)})
+	}
+	return cards
+}
+
+// checkCards reports an error if any card in want
+// is missing from have or appears more than once,
+// or if have contains any cards not in want.
+func checkCards(want []*Card, have ...[]*Card) error {
+	count := make(map[*Card]int)
+	for _, c := range want {
+		count[c] = 0
+	}
+	for _, cards := range have {
+		for _, c := range cards {
+			if _, ok := count[c]; !ok {
+				return fmt.Errorf("unexpected card %q", c.Name)
+			}
+			count[c]++
+		}
+	}
+	for _, c := range want {
+		switch count[c] {
+		case 0:
+			return fmt.Errorf("card %q was lost", c.Name)
+		case 1:
+		default:
+			return fmt.Errorf("card %q appears %d times", c.Name, count[c])
+		}
+	}
+	return nil
+}
+
+func TestDeckConservesCards(t *testing.T) {
+	// Each op either draws a card or discards one of the held cards.
+	f := func(size uint8, ops []uint8) bool {
+		cards := testCards(int(size))
+		d := newDeck(rand.New(rand.NewSource(1)), cards)
+		var held []*Card
+		for _, op := range ops {
+			if op%3 == 0 && len(held) > 0 {
+				i := int(op) % len(held)
+				d.Discard(held[i])
+				held = append(held[:i], held[i+1:]...)
+			} else if c, ok := d.Draw(); ok {
+				held = append(held, c)
+			} else if len(held) != len(cards) {
+				t.Logf("Draw failed with %d of %d cards held", len(held), len(cards))
+				return false
+			}
+			if d.Len()+len(held) != len(cards) {
+				t.Logf("Len() = %d with %d of %d cards held", d.Len(), len(held), len(cards))
+				return false
+			}
+			if err := checkCards(cards, d.draw, d.discard, held); err != nil {
+				t.Log(err)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeckReshuffle(t *testing.T) {
+	cards := testCards(3)
+	d := newDeck(rand.New(rand.NewSource(1)), cards)
+	for i := 0; i < 3; i++ {
+		c, _ := d.Draw()
+		d.Discard(c)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := d.Draw(); !ok {
+			t.Fatalf("Draw %d failed; discards weren't reshuffled", i)
+		}
+	}
+	if _, ok := d.Draw(); ok {
+		t.Errorf("Draw succeeded on an empty deck")
+	}
+}
+
+func newTestGame(players ...chat.Person) (*Game, *chat.Bot, *chattest.Conn) {
+	return setupGame(&Game{Source: rand.NewSource(1)}, players...)
+}
+
+// setupGame has players join g in #apples.
+func setupGame(g *Game, players ...chat.Person) (*Game, *chat.Bot, *chattest.Conn) {
+	b, _ := chat.NewBot()
+	conn := new(chattest.Conn)
+	b.AddConn(conn)
+	for _, p := range players {
+		g.Event(b, &chat.Message{Conn: conn, From: p, Room: "#apples", Text: "magicalbot: join"})
+	}
+	return g, b, conn
+}
+
+// checkGameCards checks that every card is in exactly one place.
+func checkGameCards(g *Game) error {
+	var red, green [][]*Card
+	red = append(red, g.red.draw, g.red.discard)
+	green = append(green, g.green.draw, g.green.discard)
+	for _, hand := range g.hand {
+		red = append(red, hand)
+	}
+	for _, cards := range g.plays {
+		red = append(red, cards)
+	}
+	for _, cards := range g.won {
+		green = append(green, cards)
+	}
+	if g.greenCard != nil {
+		green = append(green, []*Card{g.greenCard})
+	}
+	if err := checkCards(redCards, red...); err != nil {
+		return fmt.Errorf("red: %v", err)
+	}
+	if err := checkCards(greenCards, green...); err != nil {
+		return fmt.Errorf("green: %v", err)
+	}
+	return nil
+}
+
+func TestGamePlaysUntilDecksRunOut(t *testing.T) {
+	g, b, conn := newTestGame("alice", "bob", "carol")
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+	rounds := 0
+	for g.table.Phase() != "" {
+		if err := checkGameCards(g); err != nil {
+			t.Fatalf("round %d: %v", rounds, err)
+		}
+		for _, p := range g.table.Players() {
+			if p != g.judge {
+				if err := g.play(g.table, p, 0); err != nil {
+					t.Fatalf("round %d: %s: play: %v", rounds, p, err)
+				}
+			}
+		}
+		if err := g.pick(g.table, g.judge, 0); err != nil {
+			t.Fatalf("round %d: pick: %v", rounds, err)
+		}
+		rounds++
+		if rounds > len(greenCards) {
+			t.Fatalf("game didn't end after %d rounds", rounds)
+		}
+	}
+	if rounds != len(greenCards) {
+		t.Errorf("played %d rounds, want %d", rounds, len(greenCards))
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Errorf("after game: %v", err)
+	}
+	if g.red.Len() != len(redCards) || g.green.Len() != len(greenCards) {
+		t.Errorf("cards weren't returned to the decks after the game")
+	}
+}
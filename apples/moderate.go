@@ -0,0 +1,50 @@
+package apples
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+)
+
+// moderate carries out one of the moderator's commands
+// which the table doesn't handle itself: skip, or setjudge nick.
+func (g *Game) moderate(t *games.Table, m *chat.Message, command, arg string) error {
+	if t.Phase() == "" {
+		return errors.New("there is no game in progress")
+	}
+	if !t.IsMod(m.From) {
+		return fmt.Errorf("only the moderator (%s) can do that", t.Mod())
+	}
+	switch command {
+	case "skip":
+		t.Announce(fmt.Sprintf("skipping %s", g.greenCard.Name))
+		g.cancelPlays()
+		g.green.Discard(g.greenCard)
+		g.greenCard = nil
+		g.startRound(t)
+	case "setjudge":
+		p := chat.Person(arg)
+		if !t.Playing(p) {
+			return fmt.Errorf("%s isn't playing", p)
+		}
+		if p == g.judge {
+			return fmt.Errorf("%s is already judging", p)
+		}
+		g.judge = p
+		g.cancelPlays()
+		t.SetPhase("play", g.TimeLimit)
+		for _, p := range t.Players() {
+			g.list(t, p)
+		}
+		t.Announce("the round has been restarted")
+		t.Announce(fmt.Sprintf("%s is judging", g.judge))
+		if !g.rules[appleTurnovers] {
+			g.announceGreen(t)
+		}
+	default:
+		return games.ErrUnknownCommand
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package apples
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+)
+
+// A Player identifies someone who took part in a round.
+// ID is stable across nick changes; Nick is what they were called at the time.
+type Player struct {
+	ID   string
+	Nick chat.Person
+}
+
+// A Round is the record of a finished round.
+type Round struct {
+	Game    string // identifies the game the round was part of
+	Time    time.Time
+	Room    chat.Room
+	Judge   Player
+	Winner  Player
+	Players []Player // everyone who played a red card, including the winner
+	Green   string   // the green card
+	Red     string   // the winning red card or cards
+}
+
+// A StatsStore keeps a history of finished rounds.
+type StatsStore interface {
+	AddRound(r *Round) error
+	Rounds() ([]*Round, error)
+}
+
+// FileStats is a StatsStore which appends rounds to a file,
+// one JSON object per line.
+type FileStats string
+
+func (f FileStats) AddRound(r *Round) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(string(f), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f FileStats) Rounds() ([]*Round, error) {
+	file, err := os.Open(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rounds []*Round
+	s := bufio.NewScanner(file)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		r := new(Round)
+		if err := json.Unmarshal(s.Bytes(), r); err != nil {
+			// a crash may have left a partial line at the end
+			continue
+		}
+		rounds = append(rounds, r)
+	}
+	return rounds, s.Err()
+}
+
+// player returns the Player record for p.
+func player(t *games.Table, p chat.Person) Player {
+	return Player{ID: t.PlayerID(p), Nick: p}
+}
+
+// record saves the result of the current round to g.Stats.
+func (g *Game) record(t *games.Table, winner playedCard) {
+	if g.Stats == nil {
+		return
+	}
+	r := &Round{
+		Game:   t.ID(),
+		Time:   time.Now(),
+		Room:   t.Room(),
+		Judge:  player(t, g.judge),
+		Winner: player(t, winner.player),
+		Green:  g.greenCard.Name,
+		Red:    winner.name(),
+	}
+	for _, pc := range g.redCards {
+		r.Players = append(r.Players, player(t, pc.player))
+	}
+	if err := g.Stats.AddRound(r); err != nil {
+		log.Printf("error recording round: %v", err)
+	}
+}
+
+// playerStats summarizes the rounds a single player took part in.
+type playerStats struct {
+	nick     chat.Person
+	games    map[string]bool
+	played   int            // rounds played (not judged)
+	won      int            // rounds won
+	judged   int            // rounds judged
+	cards    map[string]int // winning red cards
+	pickedBy map[string]int // judges who picked this player's cards
+	picked   map[string]int // winners this player picked as judge
+}
+
+func (s *playerStats) winRate() float64 {
+	if s.played == 0 {
+		return 0
+	}
+	return float64(s.won) / float64(s.played)
+}
+
+// tally computes stats for every player from a list of rounds.
+// Rounds before since are ignored.
+func tally(rounds []*Round, since time.Time) map[string]*playerStats {
+	stats := make(map[string]*playerStats)
+	get := func(p Player) *playerStats {
+		s := stats[p.ID]
+		if s == nil {
+			s = &playerStats{
+				games:    make(map[string]bool),
+				cards:    make(map[string]int),
+				pickedBy: make(map[string]int),
+				picked:   make(map[string]int),
+			}
+			stats[p.ID] = s
+		}
+		// rounds are in chronological order, so this is the latest nick
+		s.nick = p.Nick
+		return s
+	}
+	for _, r := range rounds {
+		if r.Time.Before(since) {
+			continue
+		}
+		judge := get(r.Judge)
+		judge.games[r.Game] = true
+		judge.judged++
+		judge.picked[r.Winner.ID]++
+		for _, p := range r.Players {
+			s := get(p)
+			s.games[r.Game] = true
+			s.played++
+		}
+		winner := get(r.Winner)
+		winner.won++
+		winner.cards[r.Red]++
+		winner.pickedBy[r.Judge.ID]++
+	}
+	return stats
+}
+
+// top returns the keys of m with the highest counts, at most n of them.
+func top(m map[string]int, n int) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if m[keys[i]] != m[keys[j]] {
+			return m[keys[i]] > m[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// lookupPlayer finds the ID of the player most recently known as nick.
+func lookupPlayer(rounds []*Round, nick string) (string, bool) {
+	for i := len(rounds) - 1; i >= 0; i-- {
+		r := rounds[i]
+		for _, p := range append([]Player{r.Judge}, r.Players...) {
+			if strings.EqualFold(string(p.Nick), nick) {
+				return p.ID, true
+			}
+		}
+	}
+	return "", false
+}
+
+// stats reports statistics for the named player,
+// or for the sender of m if name is empty.
+func (g *Game) stats(t *games.Table, m *chat.Message, name string) error {
+	if g.Stats == nil {
+		return errors.New("stats are not enabled")
+	}
+	rounds, err := g.Stats.Rounds()
+	if err != nil {
+		log.Printf("error reading stats: %v", err)
+		return errors.New("couldn't read stats")
+	}
+	var id string
+	if name == "" {
+		name = string(m.From)
+		id = t.Identity(m)
+	} else if i, ok := lookupPlayer(rounds, name); ok {
+		id = i
+	}
+	all := tally(rounds, time.Time{})
+	s := all[id]
+	if s == nil {
+		return fmt.Errorf("no stats for %s", name)
+	}
+	nick := func(id string) chat.Person {
+		if s := all[id]; s != nil {
+			return s.nick
+		}
+		return chat.Person(id)
+	}
+	msg := fmt.Sprintf("%s: %d games, %d rounds played, %d won (%.0f%%), %d judged",
+		s.nick, len(s.games), s.played, s.won, 100*s.winRate(), s.judged)
+	if cards := top(s.cards, 3); len(cards) > 0 {
+		msg += "; favourite cards: " + strings.Join(cards, ", ")
+	}
+	if ids := top(s.pickedBy, 1); len(ids) > 0 {
+		msg += fmt.Sprintf("; picked most by %s (%d)", nick(ids[0]), s.pickedBy[ids[0]])
+	}
+	if ids := top(s.picked, 1); len(ids) > 0 {
+		msg += fmt.Sprintf("; picks %s most (%d)", nick(ids[0]), s.picked[ids[0]])
+	}
+	t.Reply(m, msg)
+	return nil
+}
+
+var leaderboardPeriods = map[string]time.Duration{
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"all":     0,
+}
+
+const leaderboardSize = 5
+
+// leaderboard announces the players who have won the most rounds
+// in the given period: daily, weekly, monthly, or all (the default).
+func (g *Game) leaderboard(t *games.Table, m *chat.Message, period string) error {
+	if g.Stats == nil {
+		return errors.New("stats are not enabled")
+	}
+	if period == "" {
+		period = "all"
+	}
+	d, ok := leaderboardPeriods[period]
+	if !ok {
+		return errors.New("period must be daily, weekly, monthly or all")
+	}
+	var since time.Time
+	if d != 0 {
+		since = time.Now().Add(-d)
+	}
+	rounds, err := g.Stats.Rounds()
+	if err != nil {
+		log.Printf("error reading stats: %v", err)
+		return errors.New("couldn't read stats")
+	}
+	stats := tally(rounds, since)
+	wins := make(map[string]int)
+	for id, s := range stats {
+		if s.won > 0 {
+			wins[id] = s.won
+		}
+	}
+	ids := top(wins, leaderboardSize)
+	if len(ids) == 0 {
+		t.Reply(m, "nobody has won anything yet")
+		return nil
+	}
+	var lines []string
+	for i, id := range ids {
+		s := stats[id]
+		lines = append(lines, fmt.Sprintf("%d. %s: %d wins in %d rounds", i+1, s.nick, s.won, s.played))
+	}
+	t.Reply(m, period+" leaderboard: "+strings.Join(lines, "; "))
+	return nil
+}
@@ -0,0 +1,62 @@
+package apples
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTally(t *testing.T) {
+	alice := Player{"alice", "alice"}
+	bob := Player{"bob", "bob"}
+	carol := Player{"carol", "carol_"}
+	now := time.Now()
+	rounds := []*Round{
+		{Game: "1", Time: now.Add(-30 * 24 * time.Hour), Judge: alice, Winner: bob, Players: []Player{bob, carol}, Red: "Bananas"},
+		{Game: "2", Time: now, Judge: bob, Winner: carol, Players: []Player{alice, carol}, Red: "Bananas"},
+		{Game: "2", Time: now, Judge: carol, Winner: bob, Players: []Player{alice, bob}, Red: "Cheese"},
+	}
+
+	stats := tally(rounds, time.Time{})
+	b := stats["bob"]
+	if len(b.games) != 2 || b.played != 2 || b.won != 2 || b.judged != 1 {
+		t.Errorf("bob: got %d games, %d played, %d won, %d judged; want 2, 2, 2, 1",
+			len(b.games), b.played, b.won, b.judged)
+	}
+	if b.winRate() != 1 {
+		t.Errorf("bob: win rate = %v, want 1", b.winRate())
+	}
+	if b.pickedBy["alice"] != 1 || b.pickedBy["carol"] != 1 {
+		t.Errorf("bob: pickedBy = %v", b.pickedBy)
+	}
+	if stats["carol"].nick != "carol_" {
+		t.Errorf("carol: nick = %q, want carol_", stats["carol"].nick)
+	}
+
+	weekly := tally(rounds, now.Add(-7*24*time.Hour))
+	if weekly["bob"].won != 1 {
+		t.Errorf("bob: weekly wins = %d, want 1", weekly["bob"].won)
+	}
+	if weekly["alice"].judged != 0 {
+		t.Errorf("alice: weekly judged = %d, want 0", weekly["alice"].judged)
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	f := FileStats(filepath.Join(t.TempDir(), "stats.jsonl"))
+	if rounds, err := f.Rounds(); err != nil || len(rounds) != 0 {
+		t.Fatalf("empty store: got %d rounds, %v", len(rounds), err)
+	}
+	for _, red := range []string{"Bananas", "Cheese"} {
+		if err := f.AddRound(&Round{Game: "1", Red: red}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rounds, err := f.Rounds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rounds) != 2 || rounds[0].Red != "Bananas" || rounds[1].Red != "Cheese" {
+		t.Errorf("got %+v", rounds)
+	}
+}
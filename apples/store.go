@@ -0,0 +1,164 @@
+package apples
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/magical/chat"
+)
+
+// savedGame is the serialized form of a Game.
+// The players, phase and so on are saved by the games.Table;
+// this is just the cards. Cards are stored by name.
+type savedGame struct {
+	Judge   chat.Person
+	Hands   map[chat.Person][]string
+	Won     map[chat.Person][]string
+	Rules   []string
+	Plays   map[chat.Person][]string
+	Green   string
+	Judging []savedPlay `json:",omitempty"`
+
+	RedDraw      []string
+	RedDiscard   []string
+	GreenDraw    []string
+	GreenDiscard []string
+}
+
+type savedPlay struct {
+	Player chat.Person
+	Cards  []string
+}
+
+// MarshalJSON implements json.Marshaler, so that the table can save the game.
+func (g *Game) MarshalJSON() ([]byte, error) {
+	return json.Marshal(g.marshal())
+}
+
+// UnmarshalJSON implements json.Unmarshaler, so that the table can restore the game.
+func (g *Game) UnmarshalJSON(data []byte) error {
+	var s savedGame
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return g.unmarshal(&s)
+}
+
+func (g *Game) marshal() *savedGame {
+	s := &savedGame{
+		Judge: g.judge,
+		Hands: make(map[chat.Person][]string),
+		Won:   make(map[chat.Person][]string),
+		Plays: make(map[chat.Person][]string),
+	}
+	for p, hand := range g.hand {
+		s.Hands[p] = cardNames(hand)
+	}
+	for p, cards := range g.won {
+		s.Won[p] = cardNames(cards)
+	}
+	for name := range g.rules {
+		s.Rules = append(s.Rules, name)
+	}
+	sort.Strings(s.Rules)
+	for p, cards := range g.plays {
+		s.Plays[p] = cardNames(cards)
+	}
+	if g.greenCard != nil {
+		s.Green = g.greenCard.Name
+	}
+	for _, pc := range g.redCards {
+		s.Judging = append(s.Judging, savedPlay{pc.player, cardNames(pc.cards)})
+	}
+	if g.red != nil {
+		s.RedDraw = cardNames(g.red.draw)
+		s.RedDiscard = cardNames(g.red.discard)
+	}
+	if g.green != nil {
+		s.GreenDraw = cardNames(g.green.draw)
+		s.GreenDiscard = cardNames(g.green.discard)
+	}
+	return s
+}
+
+func (g *Game) unmarshal(s *savedGame) error {
+	red := cardsByName(redCards)
+	green := cardsByName(greenCards)
+	var missing []string
+	lookup := func(cards map[string]*Card, names ...string) []*Card {
+		out := make([]*Card, 0, len(names))
+		for _, name := range names {
+			if c, ok := cards[name]; ok {
+				out = append(out, c)
+			} else {
+				missing = append(missing, name)
+			}
+		}
+		return out
+	}
+
+	hand := make(map[chat.Person][]*Card)
+	for p, names := range s.Hands {
+		hand[p] = lookup(red, names...)
+	}
+	won := make(map[chat.Person][]*Card)
+	for p, names := range s.Won {
+		won[p] = lookup(green, names...)
+	}
+	rules := make(map[string]bool)
+	for _, name := range s.Rules {
+		if _, ok := variantNames[name]; !ok {
+			return fmt.Errorf("unknown variant in saved game: %q", name)
+		}
+		rules[name] = true
+	}
+	plays := make(map[chat.Person][]*Card)
+	for p, names := range s.Plays {
+		plays[p] = lookup(red, names...)
+	}
+	var greenCard *Card
+	if s.Green != "" {
+		if c := lookup(green, s.Green); len(c) == 1 {
+			greenCard = c[0]
+		}
+	}
+	var judging []playedCard
+	for _, sp := range s.Judging {
+		judging = append(judging, playedCard{sp.Player, lookup(red, sp.Cards...)})
+	}
+	// the table seeds its random number generator before restoring the rules
+	r := g.Table().Rand()
+	redDeck := &deck{draw: lookup(red, s.RedDraw...), discard: lookup(red, s.RedDiscard...), rand: r}
+	greenDeck := &deck{draw: lookup(green, s.GreenDraw...), discard: lookup(green, s.GreenDiscard...), rand: r}
+	if len(missing) > 0 {
+		return fmt.Errorf("unknown cards in saved game: %q", missing)
+	}
+
+	g.judge = s.Judge
+	g.hand = hand
+	g.won = won
+	g.rules = rules
+	g.plays = plays
+	g.greenCard = greenCard
+	g.redCards = judging
+	g.red = redDeck
+	g.green = greenDeck
+	return nil
+}
+
+func cardNames(cards []*Card) []string {
+	names := make([]string, len(cards))
+	for i, c := range cards {
+		names[i] = c.Name
+	}
+	return names
+}
+
+func cardsByName(cards []*Card) map[string]*Card {
+	m := make(map[string]*Card, len(cards))
+	for _, c := range cards {
+		m[c.Name] = c
+	}
+	return m
+}
@@ -0,0 +1,52 @@
+package apples
+
+import (
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+)
+
+func TestSaveRestore(t *testing.T) {
+	store := games.FileStore(filepath.Join(t.TempDir(), "apples.json"))
+	g, b, conn := setupGame(&Game{Store: store, Source: rand.NewSource(1)}, "alice", "bob", "carol")
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			g.Event(b, &chat.Message{Conn: conn, From: p, Text: "play 3"})
+		}
+	}
+	if g.table.Phase() != "judge" {
+		t.Fatalf("state = %q, want judge", g.table.Phase())
+	}
+
+	h := &Game{Store: store, Source: rand.NewSource(2)}
+	if err := h.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if h.table.Phase() != "judge" || !h.table.Playing("carol") {
+		t.Errorf("restored table: phase = %q, players = %v", h.table.Phase(), h.table.Players())
+	}
+	if err := checkGameCards(h); err != nil {
+		t.Error(err)
+	}
+	if want, got := g.marshal(), h.marshal(); !reflect.DeepEqual(want, got) {
+		t.Errorf("restored game differs:\nwant %+v\n got %+v", want, got)
+	}
+
+	// The room is told about the game when the bot rejoins it,
+	// and the restored game should carry on where the old one left off.
+	h.Event(b, &chat.Message{Conn: conn, Kind: chat.KindJoin, From: "magicalbot", Room: "#apples"})
+	if !conn.Said("#apples", "the game has resumed") {
+		t.Errorf("resumed game wasn't announced: %q", conn.Sent)
+	}
+	if err := h.pick(h.table, h.judge, 0); err != nil {
+		t.Fatal(err)
+	}
+	if h.table.Phase() != "play" || h.judge != "bob" {
+		t.Errorf("after pick: state = %q, judge = %q; want play, bob", h.table.Phase(), h.judge)
+	}
+}
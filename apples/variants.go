@@ -0,0 +1,80 @@
+package apples
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+)
+
+// House rules which can be enabled before a game starts.
+const (
+	crabApples     = "crab"     // the judge picks the least fitting card
+	appleTurnovers = "turnover" // red cards are revealed before the green card
+	badHarvest     = "harvest"  // everyone plays two red cards
+	privateJudging = "private"  // the judge picks over PM
+)
+
+var variantNames = map[string]string{
+	crabApples:     "Crab Apples",
+	appleTurnovers: "Apple Turnovers",
+	badHarvest:     "Bad Harvest",
+	privateJudging: "Private Judging",
+}
+
+// variant enables or disables a house rule.
+// Only the moderator may change the rules, and only before the game starts.
+func (g *Game) variant(t *games.Table, m *chat.Message, name string, on bool) error {
+	if _, ok := variantNames[name]; !ok {
+		return fmt.Errorf("no such variant; try %s", strings.Join(allVariants(), ", "))
+	}
+	if t.Phase() != "" {
+		return errors.New("a game is already in progress")
+	}
+	if !t.IsMod(m.From) {
+		return errors.New("only the moderator can change the rules")
+	}
+	if g.rules == nil {
+		g.rules = make(map[string]bool)
+	}
+	if on {
+		g.rules[name] = true
+		t.Reply(m, variantNames[name]+" enabled")
+	} else {
+		delete(g.rules, name)
+		t.Reply(m, variantNames[name]+" disabled")
+	}
+	return nil
+}
+
+// allVariants returns the short names of all the variants, in order.
+func allVariants() []string {
+	var names []string
+	for name := range variantNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// enabledVariants returns the full names of the enabled variants.
+func (g *Game) enabledVariants() []string {
+	var names []string
+	for _, name := range allVariants() {
+		if g.rules[name] {
+			names = append(names, variantNames[name])
+		}
+	}
+	return names
+}
+
+// cardsPerPlay returns how many red cards each player plays per round.
+func (g *Game) cardsPerPlay() int {
+	if g.rules[badHarvest] {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,184 @@
+package apples
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/internal/chattest"
+)
+
+// startVariant starts a three-player game with the given variants enabled.
+func startVariant(t *testing.T, variants ...string) (*Game, *chat.Bot, *chattest.Conn) {
+	g, b, conn := newTestGame("alice", "bob", "carol")
+	for _, v := range variants {
+		g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: variant " + v})
+		if !g.rules[v] {
+			t.Fatalf("variant %s wasn't enabled: %q", v, conn.Sent)
+		}
+	}
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: start"})
+	if g.table.Phase() != "play" {
+		t.Fatalf("game didn't start: %q", conn.Sent)
+	}
+	return g, b, conn
+}
+
+func TestVariantOnlyModerator(t *testing.T) {
+	g, b, conn := newTestGame("alice", "bob")
+	g.Event(b, &chat.Message{Conn: conn, From: "bob", Room: "#apples", Text: "magicalbot: variant crab"})
+	if g.rules[crabApples] {
+		t.Errorf("bob enabled a variant, but alice is the moderator")
+	}
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: variant crab"})
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: variant crab off"})
+	if g.rules[crabApples] {
+		t.Errorf("variant crab off didn't disable crab apples")
+	}
+}
+
+func TestCrabApples(t *testing.T) {
+	g, _, conn := startVariant(t, crabApples)
+	green := g.greenCard.Name
+	if !conn.Said("#apples", "least "+green) {
+		t.Errorf("crab apples wasn't announced: %q", conn.Sent)
+	}
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			g.play(g.table, p, 0)
+		}
+	}
+	if !conn.Said("#apples", "choose the least appropriate card") {
+		t.Errorf("judge wasn't asked for the least appropriate card: %q", conn.Sent)
+	}
+}
+
+func TestAppleTurnovers(t *testing.T) {
+	g, _, conn := startVariant(t, appleTurnovers)
+	green := "the green card is " + chat.Bold(g.greenCard.Name)
+	if conn.Said("#apples", green) {
+		t.Fatalf("green card was revealed before anyone played")
+	}
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			g.play(g.table, p, 0)
+		}
+	}
+	if !conn.Said("#apples", green) {
+		t.Fatalf("green card wasn't revealed after everyone played: %q", conn.Sent)
+	}
+	// the red cards must come before the green card
+	var red, reveal int
+	for i, line := range conn.Sent {
+		if strings.HasPrefix(line, "#apples 0: ") {
+			red = i
+		}
+		if strings.Contains(line, green) {
+			reveal = i
+		}
+	}
+	if red > reveal {
+		t.Errorf("red cards were announced after the green card: %q", conn.Sent)
+	}
+}
+
+func TestBadHarvest(t *testing.T) {
+	g, _, _ := startVariant(t, badHarvest)
+	var player chat.Person
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			player = p
+			break
+		}
+	}
+	if err := g.play(g.table, player, 0); err == nil {
+		t.Errorf("playing one card should fail in bad harvest")
+	}
+	if err := g.play(g.table, player, 1, 1); err == nil {
+		t.Errorf("playing the same card twice should fail")
+	}
+	hand := append([]*Card(nil), g.hand[player]...)
+	if err := g.play(g.table, player, 1, 4); err != nil {
+		t.Fatal(err)
+	}
+	if got := g.plays[player]; len(got) != 2 || got[0] != hand[1] || got[1] != hand[4] {
+		t.Errorf("played %v, want cards 1 and 4 of %v", got, hand)
+	}
+	if len(g.hand[player]) != handSize-2 {
+		t.Errorf("hand has %d cards, want %d", len(g.hand[player]), handSize-2)
+	}
+	// changing your mind puts the old cards back
+	if err := g.play(g.table, player, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range g.table.Players() {
+		if p != g.judge && p != player {
+			g.play(g.table, p, 0, 1)
+		}
+	}
+	if g.table.Phase() != "judge" {
+		t.Fatalf("state = %q, want judge", g.table.Phase())
+	}
+	winner := g.redCards[0].player
+	if err := g.pick(g.table, g.judge, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(g.won[winner]) != 1 {
+		t.Errorf("%s won %d green cards, want 1", winner, len(g.won[winner]))
+	}
+	for _, p := range g.table.Players() {
+		if len(g.hand[p]) != handSize {
+			t.Errorf("%s has %d cards after the round, want %d", p, len(g.hand[p]), handSize)
+		}
+	}
+	if err := checkGameCards(g); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBadHarvestRunsOut(t *testing.T) {
+	g, _, conn := startVariant(t, badHarvest)
+	var player chat.Person
+	for _, p := range g.table.Players() {
+		if p != g.judge {
+			player = p
+			break
+		}
+	}
+	// one card left in hand, and none to draw
+	g.hand[player] = g.hand[player][:1]
+	g.red.draw, g.red.discard = nil, nil
+	g.startRound(g.table)
+	if g.table.Phase() != "" || !conn.Said("#apples", "the red deck is empty") {
+		t.Errorf("%s can't play two cards, but the game went on: phase %q", player, g.table.Phase())
+	}
+}
+
+func TestPrivateJudging(t *testing.T) {
+	g, b, conn := startVariant(t, privateJudging)
+	g.play(g.table, "bob", 0)
+	if !conn.Said("#apples", "1/2 played, waiting on carol") {
+		t.Errorf("progress wasn't announced: %q", conn.Sent)
+	}
+	g.play(g.table, "carol", 0)
+	if !conn.Said("alice", "0: ") {
+		t.Errorf("the cards weren't sent to the judge: %q", conn.Sent)
+	}
+
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#apples", Text: "magicalbot: pick 0"})
+	if g.table.Phase() != "judge" {
+		t.Fatalf("judge picked in the room")
+	}
+	winner := g.redCards[0].player
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Text: "pick 0"})
+	if g.table.Phase() != "play" || len(g.won[winner]) != 1 {
+		t.Fatalf("judge couldn't pick privately: %q", conn.Sent)
+	}
+	if !conn.Said("#apples", "bob played") || !conn.Said("#apples", "carol played") {
+		t.Errorf("who played what wasn't revealed: %q", conn.Sent)
+	}
+}
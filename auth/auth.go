@@ -0,0 +1,479 @@
+// Package auth decides who may tell the bot to do what.
+//
+// People are known by the accounts they are logged in to on each of the
+// bot's connections (see chat.Sender), never by nick. Accounts on different
+// connections can be linked into one identity, which has a role.
+// To link an account, someone asks for a one-time code from an account
+// they have already, and repeats it from the account to be linked,
+// which proves they own both.
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magical/chat"
+)
+
+// A Role is how far someone is trusted.
+type Role int
+
+const (
+	Banned Role = iota - 1 // ignored entirely
+	User                   // the default
+	Admin
+	Owner
+)
+
+var roleNames = map[Role]string{Banned: "banned", User: "user", Admin: "admin", Owner: "owner"}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+// ParseRole parses a role name, such as "admin".
+func ParseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if strings.EqualFold(s, name) {
+			return r, nil
+		}
+	}
+	return User, fmt.Errorf("no such role %q", s)
+}
+
+func (r Role) MarshalText() ([]byte, error) { return []byte(r.String()), nil }
+
+func (r *Role) UnmarshalText(b []byte) error {
+	role, err := ParseRole(string(b))
+	*r = role
+	return err
+}
+
+// An Identity is one person, with all the accounts they have linked.
+type Identity struct {
+	Name     string
+	Role     Role
+	Accounts []string // each CONN:ACCOUNT, with the connection's name
+}
+
+// A Store saves identities; games.FileStore will do.
+type Store interface {
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// codeLifetime is how long a link code can be used for.
+const codeLifetime = 10 * time.Minute
+
+type linkCode struct {
+	identity string
+	expires  time.Time
+}
+
+// Auth keeps track of identities and checks permissions.
+// Add it to a bot with both Guard, to check messages before they
+// are handled, and Handle, for its commands:
+//
+//	auth whoami - show your identity and role
+//	auth link - get a code for linking another account to your identity
+//	auth confirm CODE - link the account you say this from
+//	auth role NAME ROLE - admins set someone's role
+type Auth struct {
+	// Store, if not nil, keeps identities across restarts.
+	Store Store
+
+	// Commands gives the least role needed to use a command.
+	// Keys are read the way games.Table reads commands: "abort" is
+	// "magicalbot: abort" for a table without a name, and abort
+	// after any table's name, such as "magicalbot: trivia abort";
+	// "trivia abort" is only the table named trivia's abort.
+	// Other commands need only User.
+	Commands map[string]Role
+
+	// ConnRoles gives the role of people without an identity
+	// on particular connections, by connection name: a console,
+	// say, might be trusted as Owner. Otherwise they are Users.
+	ConnRoles map[string]Role
+
+	mu       sync.Mutex
+	ids      map[string]*Identity // by name
+	accounts map[string]string    // CONN:ACCOUNT -> identity name
+	codes    map[string]linkCode
+}
+
+// account returns the CONN:ACCOUNT key for the sender of m,
+// or "" if they aren't logged in to an account.
+func account(m *chat.Message) string {
+	if m.Sender.Account == "" {
+		return ""
+	}
+	return m.Sender.Conn + ":" + m.Sender.Account
+}
+
+// Identity returns the identity of the sender of m, or nil if they have none.
+func (a *Auth) Identity(m *chat.Message) *Identity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id := a.identity(m); id != nil {
+		c := *id
+		c.Accounts = append([]string(nil), id.Accounts...)
+		return &c
+	}
+	return nil
+}
+
+// identity finds the identity of the sender of m. The caller must hold a.mu.
+func (a *Auth) identity(m *chat.Message) *Identity {
+	key := account(m)
+	if key == "" {
+		return nil
+	}
+	return a.ids[a.accounts[key]]
+}
+
+// Role returns the role of the sender of m.
+func (a *Auth) Role(m *chat.Message) Role {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.role(m)
+}
+
+func (a *Auth) role(m *chat.Message) Role {
+	if id := a.identity(m); id != nil {
+		return id.Role
+	}
+	if r, ok := a.ConnRoles[m.Sender.Conn]; ok {
+		return r
+	}
+	return User
+}
+
+// SetIdentity creates or updates an identity, linking the given accounts
+// (each CONN:ACCOUNT) to it. It is meant for setting up the first owner.
+func (a *Auth) SetIdentity(name string, role Role, accounts ...string) error {
+	name = strings.ToLower(name)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, acct := range accounts {
+		if other, ok := a.accounts[acct]; ok && other != name {
+			return fmt.Errorf("auth: %s is already linked to %s", acct, other)
+		}
+	}
+	id := a.ids[name]
+	if id == nil {
+		id = a.newIdentity(name, role)
+	}
+	id.Role = role
+	for _, acct := range accounts {
+		a.link(id, acct)
+	}
+	a.save()
+	return nil
+}
+
+// newIdentity adds an identity. The caller must hold a.mu.
+func (a *Auth) newIdentity(name string, role Role) *Identity {
+	if a.ids == nil {
+		a.ids = make(map[string]*Identity)
+	}
+	id := &Identity{Name: name, Role: role}
+	a.ids[name] = id
+	return id
+}
+
+// link adds an account to an identity. The caller must hold a.mu.
+func (a *Auth) link(id *Identity, acct string) {
+	if a.accounts == nil {
+		a.accounts = make(map[string]string)
+	}
+	if a.accounts[acct] == id.Name {
+		return
+	}
+	a.accounts[acct] = id.Name
+	id.Accounts = append(id.Accounts, acct)
+}
+
+// Allow implements chat.Guard. Banned people are ignored,
+// and commands are checked against Commands.
+// People can still come and go, so that games notice them leaving.
+func (a *Auth) Allow(b *chat.Bot, m *chat.Message) bool {
+	switch m.Kind {
+	case chat.KindJoin, chat.KindPart, chat.KindQuit:
+		return true
+	}
+	a.mu.Lock()
+	role := a.role(m)
+	need := a.needs(m)
+	a.mu.Unlock()
+	if role == Banned {
+		return false
+	}
+	if role < need {
+		log.Printf("auth: %s (%s) may not say %q", m.From, role, m.Text)
+		if m.Kind == chat.KindMessage {
+			b.Respond(m, "you need to be "+article(need)+" to do that")
+		}
+		return false
+	}
+	return true
+}
+
+func article(r Role) string {
+	if r == Admin || r == Owner {
+		return "an " + r.String()
+	}
+	return "a " + r.String()
+}
+
+// needs returns the role needed for the command in m. The caller must hold a.mu.
+func (a *Auth) needs(m *chat.Message) Role {
+	words, ok := command(m)
+	if !ok {
+		return User
+	}
+	if len(words) > 1 {
+		if r, ok := a.Commands[words[0]+" "+words[1]]; ok {
+			return r
+		}
+	}
+	if r, ok := a.Commands[words[0]]; ok {
+		return r
+	}
+	if len(words) > 1 {
+		// a command after a table's name
+		if r, ok := a.Commands[words[1]]; ok {
+			return r
+		}
+	}
+	return User
+}
+
+// command splits up a command directed at the bot, the same way
+// games.Table does, and reports whether m was one.
+func command(m *chat.Message) ([]string, bool) {
+	if m.Kind != chat.KindMessage {
+		return nil, false
+	}
+	if m.Room != "" && m.To == "" && !strings.HasPrefix(m.Text, "magicalbot:") {
+		return nil, false
+	}
+	words := strings.Fields(strings.TrimPrefix(m.Text, "magicalbot:"))
+	return words, len(words) > 0
+}
+
+// Event implements chat.Handler, for the auth commands.
+func (a *Auth) Event(b *chat.Bot, m *chat.Message) {
+	words, ok := command(m)
+	if !ok || words[0] != "auth" || len(words) < 2 {
+		return
+	}
+	var reply string
+	var err error
+	switch words[1] {
+	case "whoami":
+		reply = a.whoami(m)
+	case "link":
+		reply, err = a.startLink(m)
+	case "confirm":
+		if len(words) != 3 {
+			err = errors.New("usage: auth confirm CODE")
+			break
+		}
+		reply, err = a.confirm(m, words[2])
+	case "role":
+		if len(words) != 4 {
+			err = errors.New("usage: auth role NAME ROLE")
+			break
+		}
+		reply, err = a.setRole(m, words[2], words[3])
+	default:
+		err = errors.New("auth commands are whoami, link, confirm and role")
+	}
+	if err != nil {
+		reply = err.Error()
+	}
+	if reply != "" {
+		b.Respond(m, reply)
+	}
+}
+
+func (a *Auth) whoami(m *chat.Message) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if id := a.identity(m); id != nil {
+		return fmt.Sprintf("you are %s (%s), linked to %s", id.Name, id.Role, strings.Join(id.Accounts, ", "))
+	}
+	if key := account(m); key != "" {
+		return fmt.Sprintf("you are %s, with no identity (%s)", key, a.role(m))
+	}
+	return fmt.Sprintf("you aren't logged in to an account (%s)", a.role(m))
+}
+
+// startLink sends the sender of m a code to link another account with,
+// making them an identity first if they don't have one.
+// New identities are Users, whatever role the connection gives.
+func (a *Auth) startLink(m *chat.Message) (string, error) {
+	key := account(m)
+	if key == "" {
+		return "", errors.New("you need to be logged in to an account to link it")
+	}
+	code, err := newCode()
+	if err != nil {
+		log.Printf("auth: %v", err)
+		return "", errors.New("couldn't make a code")
+	}
+	a.mu.Lock()
+	id := a.identity(m)
+	if id == nil {
+		id = a.newIdentity(a.freeName(m.Sender.Account), User)
+		a.link(id, key)
+		a.save()
+	}
+	if a.codes == nil {
+		a.codes = make(map[string]linkCode)
+	}
+	now := time.Now()
+	for c, lc := range a.codes {
+		if now.After(lc.expires) {
+			delete(a.codes, c)
+		}
+	}
+	a.codes[code] = linkCode{identity: id.Name, expires: now.Add(codeLifetime)}
+	name := id.Name
+	a.mu.Unlock()
+
+	// never in a room, where someone else could use it first
+	err = m.Conn.Send(m.From, fmt.Sprintf("to link another account to %s, say \"auth confirm %s\" to me from it in the next %v",
+		name, code, codeLifetime))
+	if err != nil {
+		return "", errors.New("couldn't send you a code")
+	}
+	if m.Room != "" {
+		return "I've sent you a code privately", nil
+	}
+	return "", nil
+}
+
+// freeName returns an unused identity name based on name. The caller must hold a.mu.
+func (a *Auth) freeName(name string) string {
+	name = strings.ToLower(name)
+	unique := name
+	for i := 2; a.ids[unique] != nil; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	return unique
+}
+
+func newCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b)), nil
+}
+
+// confirm links the sender's account to the identity a code was made for.
+func (a *Auth) confirm(m *chat.Message, code string) (string, error) {
+	key := account(m)
+	if key == "" {
+		return "", errors.New("you need to be logged in to an account to link it")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	lc, ok := a.codes[strings.ToLower(code)]
+	delete(a.codes, strings.ToLower(code))
+	id := a.ids[lc.identity]
+	if !ok || time.Now().After(lc.expires) || id == nil {
+		return "", errors.New("that code is wrong or has expired")
+	}
+	if other, ok := a.accounts[key]; ok {
+		if other == id.Name {
+			return "", errors.New("that account is already linked to " + other)
+		}
+		return "", errors.New("that account belongs to " + other)
+	}
+	a.link(id, key)
+	a.save()
+	return fmt.Sprintf("linked %s to %s", key, id.Name), nil
+}
+
+// setRole changes the role of the named identity. Admins may only
+// change the roles of people below them, to roles below their own.
+func (a *Auth) setRole(m *chat.Message, name, roleName string) (string, error) {
+	role, err := ParseRole(roleName)
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	mine := a.role(m)
+	if mine < Admin {
+		return "", errors.New("you need to be an admin to do that")
+	}
+	id := a.ids[strings.ToLower(name)]
+	if id == nil {
+		return "", errors.New("nobody is called " + name)
+	}
+	if mine != Owner && (id.Role >= mine || role >= mine) {
+		return "", errors.New("only an owner can do that")
+	}
+	id.Role = role
+	a.save()
+	return fmt.Sprintf("%s is now %s", id.Name, article(role)), nil
+}
+
+// save writes the identities to a.Store. The caller must hold a.mu.
+func (a *Auth) save() {
+	if a.Store == nil {
+		return
+	}
+	var list []*Identity
+	for _, id := range a.ids {
+		list = append(list, id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.Marshal(list)
+	if err == nil {
+		err = a.Store.Save(data)
+	}
+	if err != nil {
+		log.Printf("auth: error saving identities: %v", err)
+	}
+}
+
+// Restore loads the saved identities from a.Store.
+func (a *Auth) Restore() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.Store == nil {
+		return nil
+	}
+	data, err := a.Store.Load()
+	if err != nil || data == nil {
+		return err
+	}
+	var list []*Identity
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	a.ids = nil
+	a.accounts = nil
+	for _, saved := range list {
+		id := a.newIdentity(saved.Name, saved.Role)
+		for _, acct := range saved.Accounts {
+			a.link(id, acct)
+		}
+	}
+	return nil
+}
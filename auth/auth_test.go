@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/internal/chattest"
+)
+
+type memStore struct{ data []byte }
+
+func (s *memStore) Load() ([]byte, error)  { return s.data, nil }
+func (s *memStore) Save(data []byte) error { s.data = data; return nil }
+
+// message makes a message in #games from someone logged in to account on conn.
+func message(c *chattest.Conn, conn, account, text string) *chat.Message {
+	return &chat.Message{
+		Conn:   c,
+		From:   chat.Person(account),
+		Room:   "#games",
+		Text:   text,
+		Sender: chat.Sender{Nick: account, Account: account, Conn: conn},
+	}
+}
+
+func TestAllow(t *testing.T) {
+	b, _ := chat.NewBot()
+	c := new(chattest.Conn)
+	a := &Auth{
+		Commands:  map[string]Role{"abort": Admin, "werewolf kick": Owner},
+		ConnRoles: map[string]Role{"console": Owner},
+	}
+	a.SetIdentity("root", Owner, "irc:root")
+	a.SetIdentity("Boss", Admin, "irc:boss")
+	a.SetIdentity("troll", Banned, "irc:troll")
+
+	tests := []struct {
+		conn, account, text string
+		ok                  bool
+	}{
+		{"irc", "alice", "magicalbot: join", true},
+		{"irc", "alice", "magicalbot: abort", false},
+		{"irc", "alice", "magicalbot: trivia abort", false},
+		{"irc", "alice", "magicalbot: werewolf abort", false},
+		{"irc", "alice", "magicalbot: kick bob", true},
+		{"irc", "alice", "magicalbot: werewolf kick bob", false},
+		{"irc", "alice", "abort", true}, // not a command
+		{"irc", "boss", "magicalbot: trivia abort", true},
+		{"irc", "boss", "magicalbot: werewolf kick bob", false},
+		{"irc", "root", "magicalbot: werewolf kick bob", true},
+		{"console", "", "magicalbot: werewolf kick bob", true},
+		{"irc", "troll", "hello", false},
+		{"irc", "troll", "magicalbot: join", false},
+	}
+	for _, tt := range tests {
+		if ok := a.Allow(b, message(c, tt.conn, tt.account, tt.text)); ok != tt.ok {
+			t.Errorf("%s:%s %q: allowed = %v, want %v", tt.conn, tt.account, tt.text, ok, tt.ok)
+		}
+	}
+	if !strings.Contains(strings.Join(c.Sent, "\n"), "you need to be an admin") {
+		t.Errorf("no explanation for a denied command: %q", c.Sent)
+	}
+	part := message(c, "irc", "troll", "")
+	part.Kind = chat.KindPart
+	if !a.Allow(b, part) {
+		t.Error("a banned person's part was stopped")
+	}
+}
+
+func TestLink(t *testing.T) {
+	b, _ := chat.NewBot()
+	irc, slack := new(chattest.Conn), new(chattest.Conn)
+	store := new(memStore)
+	a := &Auth{Store: store}
+
+	a.Event(b, message(irc, "irc", "Alice", "magicalbot: auth link"))
+	if !strings.Contains(irc.Last(), "sent you a code privately") {
+		t.Fatalf("link reply = %q", irc.Last())
+	}
+	private := irc.Sent[0]
+	if !strings.HasPrefix(private, "Alice ") {
+		t.Fatalf("code was sent as %q, not privately", private)
+	}
+	i := strings.Index(private, "auth confirm ")
+	code := strings.Fields(private[i+len("auth confirm "):])[0]
+	code = strings.TrimSuffix(code, `"`)
+
+	a.Event(b, message(slack, "slack", "U123", "magicalbot: auth confirm wrongcode"))
+	if !strings.Contains(slack.Last(), "wrong or has expired") {
+		t.Errorf("wrong code reply = %q", slack.Last())
+	}
+	a.Event(b, message(slack, "slack", "U123", "magicalbot: auth confirm "+code))
+	if !strings.Contains(slack.Last(), "linked slack:U123 to alice") {
+		t.Errorf("confirm reply = %q", slack.Last())
+	}
+	a.Event(b, message(slack, "slack", "U999", "magicalbot: auth confirm "+code))
+	if !strings.Contains(slack.Last(), "wrong or has expired") {
+		t.Errorf("a code worked twice: %q", slack.Last())
+	}
+
+	id := a.Identity(message(slack, "slack", "U123", ""))
+	if id == nil || id.Name != "alice" || strings.Join(id.Accounts, " ") != "irc:Alice slack:U123" {
+		t.Fatalf("identity = %+v", id)
+	}
+
+	// roles apply across linked accounts, and survive a restart
+	a.SetIdentity("root", Owner, "irc:root")
+	a.Event(b, message(irc, "irc", "root", "magicalbot: auth role alice admin"))
+	if !strings.Contains(irc.Last(), "alice is now an admin") {
+		t.Errorf("role reply = %q", irc.Last())
+	}
+	a.Event(b, message(slack, "slack", "U123", "magicalbot: auth role root banned"))
+	if !strings.Contains(slack.Last(), "only an owner") {
+		t.Errorf("an admin changed an owner: %q", slack.Last())
+	}
+	restored := &Auth{Store: store}
+	if err := restored.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if r := restored.Role(message(slack, "slack", "U123", "")); r != Admin {
+		t.Errorf("restored role = %v, want admin", r)
+	}
+	restored.Event(b, message(slack, "slack", "U123", "magicalbot: auth whoami"))
+	if want := "you are alice (admin), linked to irc:Alice, slack:U123"; !strings.Contains(slack.Last(), want) {
+		t.Errorf("whoami = %q, want %q", slack.Last(), want)
+	}
+
+	nobody := message(irc, "irc", "", "magicalbot: auth link")
+	a.Event(b, nobody)
+	if !strings.Contains(irc.Last(), "logged in") {
+		t.Errorf("link without an account = %q", irc.Last())
+	}
+
+	// trust in a connection doesn't carry over to a new identity
+	trusting := &Auth{ConnRoles: map[string]Role{"console": Owner}}
+	console := new(chattest.Conn)
+	trusting.Event(b, message(console, "console", "op", "magicalbot: auth link"))
+	if id := trusting.Identity(message(console, "console", "op", "")); id == nil || id.Role != User {
+		t.Errorf("identity made on a trusted connection = %+v, want a user", id)
+	}
+}
@@ -2,6 +2,7 @@ package chat
 
 import (
 	"log"
+	"net/url"
 	"sync"
 )
 
@@ -30,8 +31,10 @@ A highly-available autonomous agent.
 
 type Bot struct {
 	mu          sync.Mutex
-	conn        []Conn
+	conns       []ConnInfo
+	routes      map[Person]map[Conn]bool // which conns each person or room has been heard on
 	handler     []Handler
+	guards      []Guard
 	messageChan chan *Message
 }
 
@@ -44,13 +47,35 @@ type Handler interface {
 	Event(b *Bot, m *Message)
 }
 
+// A Guard decides whether a message may reach the handlers,
+// for instance by checking that the sender may use the command in it.
+type Guard interface {
+	Allow(b *Bot, m *Message) bool
+}
+
 type Room string
 type Person string
 
+// Kind distinguishes ordinary chat messages from other events
+// which are delivered to handlers as messages.
+type Kind int
+
+const (
+	KindMessage Kind = iota // an ordinary message
+	KindJoin                // From joined Room
+	KindPart                // From left Room, or was kicked from it
+	KindQuit                // From disconnected; Room is empty
+	KindAction              // From did Text, as with /me on IRC
+	KindNotice              // a notice, which bots should not reply to
+)
+
 type Message struct {
 	// Connection this message was sent over
 	Conn Conn
 
+	// What sort of message this is
+	Kind Kind
+
 	// Who is the message from
 	From Person
 
@@ -61,11 +86,37 @@ type Message struct {
 	// May be nil if the message was sent one-to-one.
 	Room Room
 
+	// The thread the message was posted in, on services which have them.
+	// Responses are posted to the same thread.
+	Thread string
+
 	// The body of the message, with any names stripped from the beginning
 	Text string
 
 	// The raw, unfiltered message
 	RawText string
+
+	// Text with its formatting, if it had any; see ParseFormatting
+	Spans []Span
+
+	// More about who sent the message than From says
+	Sender Sender
+}
+
+// A Sender describes who sent a message. Nick and Conn are always set;
+// the rest are filled in where the service provides them.
+type Sender struct {
+	Nick string
+	User string // the user name part of an IRC hostmask
+	Host string
+
+	// The account they are logged in to, which unlike a nick
+	// can't be taken by someone else: an IRC services account,
+	// or the user ID on services which have them.
+	Account string
+
+	// The name of the bot's connection it came over; see Bot.ConnName
+	Conn string
 }
 
 func NewBot() (*Bot, error) {
@@ -86,6 +137,25 @@ func (b *Bot) Serve() error {
 }
 
 func (b *Bot) dispatch(m *Message) {
+	if m.Sender.Nick == "" {
+		m.Sender.Nick = string(m.From)
+	}
+	if m.Conn != nil && m.Sender.Conn == "" {
+		m.Sender.Conn = b.ConnName(m.Conn)
+	}
+	if m.Conn != nil {
+		b.mu.Lock()
+		b.route(m.From, m.Conn)
+		if m.Room != "" {
+			b.route(Person(m.Room), m.Conn)
+		}
+		b.mu.Unlock()
+	}
+	for _, g := range b.guards {
+		if !g.Allow(b, m) {
+			return
+		}
+	}
 	for _, h := range b.handler {
 		h.Event(b, m)
 	}
@@ -102,16 +172,49 @@ func (b *Bot) dispatch(m *Message) {
 // should probably keep them separate
 //
 // There may be different types of messages;
-// for example, IRC has NOTICEs.
+// for example, IRC has NOTICEs, which are sent with Notice.
 
-// Send a message to someone
-func (b *Bot) Send(target Person, message string) {
-	// Figure out which conn this target corresponds to
-	// XXX
+// route notes that target was heard on c. The caller must hold b.mu.
+func (b *Bot) route(target Person, c Conn) {
+	if b.routes == nil {
+		b.routes = make(map[Person]map[Conn]bool)
+	}
+	if b.routes[target] == nil {
+		b.routes[target] = make(map[Conn]bool)
+	}
+	b.routes[target][c] = true
+}
+
+// connFor figures out which conn a person or room corresponds to:
+// the one we have heard from them on, or else the first one.
+// If the same name has been heard on more than one conn,
+// it could be anyone on any of them, so there is no telling
+// and it returns nil; use the Conn a message came in on instead.
+func (b *Bot) connFor(target Person) Conn {
 	b.mu.Lock()
-	c := b.conn[0]
-	b.mu.Unlock()
+	defer b.mu.Unlock()
+	switch conns := b.routes[target]; len(conns) {
+	case 0:
+		if len(b.conns) > 0 {
+			return b.conns[0].Conn
+		}
+	case 1:
+		for c := range conns {
+			return c
+		}
+	default:
+		log.Printf("%s has been heard on %d connections; not guessing which", target, len(conns))
+	}
+	return nil
+}
 
+// Send a message to someone
+func (b *Bot) Send(target Person, message string) {
+	c := b.connFor(target)
+	if c == nil {
+		log.Printf("no connection to send %q to %s", message, target)
+		return
+	}
 	c.Send(target, message)
 }
 
@@ -119,6 +222,75 @@ func (b *Bot) SendRoom(room Room, message string) {
 	b.Send(Person(room), message)
 }
 
+// A Noticer is a Conn which can send notices, like IRC's NOTICE.
+type Noticer interface {
+	Notice(to Person, message string) error
+}
+
+// Notice sends a notice to a person or room: a message which
+// clients may show less prominently and bots don't reply to,
+// good for things like listing someone's hand in a game.
+// On services without notices, it is sent as an ordinary message.
+func (b *Bot) Notice(target Person, message string) {
+	c := b.connFor(target)
+	if c == nil {
+		log.Printf("no connection to send notice %q to %s", message, target)
+		return
+	}
+	b.NoticeOn(c, target, message)
+}
+
+// NoticeOn sends a notice over a particular conn, like Notice.
+func (b *Bot) NoticeOn(c Conn, target Person, message string) {
+	if n, ok := c.(Noticer); ok {
+		n.Notice(target, message)
+		return
+	}
+	c.Send(target, message)
+}
+
+// An Actor is a Conn which can send actions, like /me on IRC.
+type Actor interface {
+	Action(room Room, text string) error
+}
+
+// Action does something in a room, like /me on IRC.
+// On services without actions, the text is sent in italics.
+func (b *Bot) Action(room Room, text string) {
+	c := b.connFor(Person(room))
+	if c == nil {
+		log.Printf("no connection to send action %q to %s", text, room)
+		return
+	}
+	if a, ok := c.(Actor); ok {
+		a.Action(room, text)
+		return
+	}
+	c.Send(Person(room), Italic(text))
+}
+
+// A Moderator is a Conn which can run rooms.
+// The methods return an error if the service refuses,
+// for instance because the bot isn't an operator.
+type Moderator interface {
+	Kick(room Room, p Person, reason string) error
+	Ban(room Room, p Person) error
+	Unban(room Room, p Person) error
+	SetMode(room Room, modes string, args ...string) error
+	SetTopic(room Room, topic string) error
+	Invite(room Room, p Person) error
+
+	// IsOp reports whether the bot is an operator in room.
+	IsOp(room Room) bool
+}
+
+// Moderator returns the Moderator for the conn room is on,
+// or nil if it can't moderate.
+func (b *Bot) Moderator(room Room) Moderator {
+	mod, _ := b.connFor(Person(room)).(Moderator)
+	return mod
+}
+
 // Respond sends a message in response to another message.
 //
 // If the original message was send privately, so will the response.
@@ -133,18 +305,37 @@ func (b *Bot) Handle(h Handler) {
 	b.handler = append(b.handler, h)
 }
 
+// Guard adds a check which every message must pass before it is handled.
+func (b *Bot) Guard(g Guard) {
+	b.guards = append(b.guards, g)
+}
+
 type HandlerFunc func(b *Bot, m *Message)
 
 func (f HandlerFunc) Event(b *Bot, m *Message) {
 	f(b, m)
 }
 
-func (b *Bot) Join(channel string) {
-	// XXX
-	c, err := DialIRC(channel, b.messageChan)
+// redactURL hides any password or token in a connection URL,
+// so that it can be logged.
+func redactURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
 	if err != nil {
-		log.Printf("error joining %s: %v", channel, err)
-		return
+		return rawurl
+	}
+	if u.User != nil {
+		u.User = url.User("xxx")
+	}
+	q := u.Query()
+	for _, key := range []string{"token", "secret"} {
+		if q.Get(key) != "" {
+			q.Set(key, "xxx")
+		}
+	}
+	if proxy, err := url.Parse(q.Get("proxy")); err == nil && proxy.User != nil {
+		proxy.User = url.User(proxy.User.Username())
+		q.Set("proxy", proxy.String())
 	}
-	b.conn = append(b.conn, c)
+	u.RawQuery = q.Encode()
+	return u.String()
 }
@@ -1,21 +1,74 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"strings"
 
 	"github.com/magical/chat"
 	"github.com/magical/chat/apples"
+	"github.com/magical/chat/auth"
+	"github.com/magical/chat/games"
+	"github.com/magical/chat/trivia"
+	"github.com/magical/chat/werewolf"
+)
+
+var (
+	owner = flag.String("owner", "", "the owner's accounts, as comma-separated CONN:ACCOUNTs such as irc.veekun.com:magical")
+	admin = flag.String("admin", "", "comma-separated commands which only admins may use, such as \"abort,trivia abort\"")
 )
 
 func main() {
+	flag.Parse()
 	bot, err := chat.NewBot()
 	if err != nil {
 		log.Fatal(err)
 	}
-	bot.Handle(&apples.Game{})
+	authz := &auth.Auth{
+		Store:    games.FileStore("auth.json"),
+		Commands: make(map[string]auth.Role),
+	}
+	for _, cmd := range strings.Split(*admin, ",") {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			authz.Commands[cmd] = auth.Admin
+		}
+	}
+	if err := authz.Restore(); err != nil {
+		log.Printf("error restoring identities: %v", err)
+	}
+	if *owner != "" {
+		if err := authz.SetIdentity("owner", auth.Owner, strings.Split(*owner, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	bot.Guard(authz)
+	bot.Handle(authz)
+	game := &apples.Game{
+		Store: games.FileStore("apples.json"),
+		Stats: apples.FileStats("apples-stats.jsonl"),
+	}
+	if err := game.Restore(); err != nil {
+		log.Printf("error restoring apples game: %v", err)
+	}
+	bot.Handle(game)
+	quiz := &trivia.Game{
+		Dir:   "trivia",
+		Store: games.FileStore("trivia.json"),
+	}
+	if err := quiz.Restore(); err != nil {
+		log.Printf("error restoring trivia game: %v", err)
+	}
+	bot.Handle(quiz)
+	wolves := &werewolf.Game{Store: games.FileStore("werewolf.json")}
+	if err := wolves.Restore(); err != nil {
+		log.Printf("error restoring werewolf game: %v", err)
+	}
+	bot.Handle(wolves)
 	//bot.Handle(chat.HandlerFunc(func(b *chat.Bot, m *chat.Message) {
 	//	b.Respond(m, "hi")
 	//}))
-	bot.Join("ircs://irc.veekun.com/magical")
+	if err := bot.Join("ircs://irc.veekun.com/magical"); err != nil {
+		log.Fatal(err)
+	}
 	log.Fatal(bot.Serve())
 }
@@ -0,0 +1,182 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// DialFunc connects to a chat service given its URL.
+// Messages received on the connection are sent to messageChan.
+type DialFunc func(rawurl string, messageChan chan<- *Message) (Conn, error)
+
+var schemes struct {
+	sync.Mutex
+	m map[string]DialFunc
+}
+
+// RegisterScheme makes a backend available to Bot.Connect
+// for URLs with the given scheme.
+// It panics if the scheme is already registered.
+func RegisterScheme(scheme string, dial DialFunc) {
+	schemes.Lock()
+	defer schemes.Unlock()
+	if dial == nil {
+		panic("chat: RegisterScheme dial func is nil")
+	}
+	if _, dup := schemes.m[scheme]; dup {
+		panic("chat: RegisterScheme called twice for " + scheme)
+	}
+	if schemes.m == nil {
+		schemes.m = make(map[string]DialFunc)
+	}
+	schemes.m[scheme] = dial
+}
+
+// Schemes returns the registered URL schemes, sorted.
+func Schemes() []string {
+	schemes.Lock()
+	defer schemes.Unlock()
+	var list []string
+	for s := range schemes.m {
+		list = append(list, s)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Dial connects to the chat service named by rawurl,
+// using the backend registered for its scheme.
+func Dial(rawurl string, messageChan chan<- *Message) (Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	schemes.Lock()
+	dial := schemes.m[u.Scheme]
+	schemes.Unlock()
+	if dial == nil {
+		return nil, fmt.Errorf("chat: unknown scheme %q", u.Scheme)
+	}
+	return dial(rawurl, messageChan)
+}
+
+// ConnInfo describes one of the bot's connections.
+type ConnInfo struct {
+	Name string
+	URL  string // with any secrets hidden; empty if added with AddConn
+	Conn Conn
+
+	// Detail describes the connection, if it can describe itself,
+	// such as the address it is connected to and its TLS settings.
+	Detail string
+}
+
+// Connect connects to a chat service and adds it to the bot under name.
+// If name is empty, one is made up from the URL.
+func (b *Bot) Connect(name, rawurl string) error {
+	b.mu.Lock()
+	if name != "" && b.findConn(name) >= 0 {
+		b.mu.Unlock()
+		return fmt.Errorf("chat: already have a connection named %q", name)
+	}
+	b.mu.Unlock()
+	c, err := Dial(rawurl, b.messageChan)
+	if err != nil {
+		return fmt.Errorf("connecting to %s: %v", redactURL(rawurl), err)
+	}
+	if name == "" {
+		name = "conn"
+		if u, err := url.Parse(rawurl); err == nil {
+			if name = u.Hostname(); name == "" {
+				name = u.Scheme
+			}
+		}
+	}
+	b.addConn(name, redactURL(rawurl), c)
+	return nil
+}
+
+// Join connects to a chat service, picking the backend by the URL's scheme;
+// see Schemes for the choices.
+func (b *Bot) Join(rawurl string) error {
+	return b.Connect("", rawurl)
+}
+
+// AddConn adds an already-established connection to the bot.
+func (b *Bot) AddConn(c Conn) {
+	b.addConn("conn", "", c)
+}
+
+// addConn adds a connection, numbering its name if it is taken.
+func (b *Bot) addConn(name, rawurl string, c Conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	unique := name
+	for i := 2; b.findConn(unique) >= 0; i++ {
+		unique = fmt.Sprintf("%s-%d", name, i)
+	}
+	b.conns = append(b.conns, ConnInfo{Name: unique, URL: rawurl, Conn: c})
+}
+
+// findConn returns the index of the named connection, or -1.
+// The caller must hold b.mu.
+func (b *Bot) findConn(name string) int {
+	for i, ci := range b.conns {
+		if ci.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Conns lists the bot's connections, in the order they were added.
+func (b *Bot) Conns() []ConnInfo {
+	b.mu.Lock()
+	list := append([]ConnInfo(nil), b.conns...)
+	b.mu.Unlock()
+	for i, ci := range list {
+		if s, ok := ci.Conn.(fmt.Stringer); ok {
+			list[i].Detail = s.String()
+		}
+	}
+	return list
+}
+
+// ConnName returns the name of a connection, or "" if the bot doesn't have it.
+func (b *Bot) ConnName(c Conn) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ci := range b.conns {
+		if ci.Conn == c {
+			return ci.Name
+		}
+	}
+	return ""
+}
+
+// RemoveConn disconnects the named connection and removes it from the bot.
+func (b *Bot) RemoveConn(name string) error {
+	b.mu.Lock()
+	i := b.findConn(name)
+	if i < 0 {
+		b.mu.Unlock()
+		return errors.New("chat: no connection named " + name)
+	}
+	c := b.conns[i].Conn
+	b.conns = append(b.conns[:i:i], b.conns[i+1:]...)
+	for p, conns := range b.routes {
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(b.routes, p)
+		}
+	}
+	b.mu.Unlock()
+	if closer, ok := c.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
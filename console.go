@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ConsoleConn talks to the bot over standard input and output,
+// for trying handlers out without a chat server.
+// Each line read is a message from one person, in one room.
+type ConsoleConn struct {
+	messageChan chan<- *Message
+	from        Person
+	room        Room
+
+	mu sync.Mutex // protects w
+	w  io.Writer
+}
+
+func init() {
+	RegisterScheme("console", func(rawurl string, messageChan chan<- *Message) (Conn, error) {
+		c, err := DialConsole(rawurl, messageChan)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+// DialConsole starts reading messages from standard input. The URL has the form
+//
+//	console://NICK/ROOM
+//
+// where NICK is who the messages are from (by default "console")
+// and ROOM is the room they are sent in, without its leading #.
+// Without a room, messages are private.
+func DialConsole(rawurl string, messageChan chan<- *Message) (*ConsoleConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "console" {
+		return nil, errors.New("DialConsole: scheme must be console://")
+	}
+	from := u.Host
+	if from == "" {
+		from = "console"
+	}
+	var room Room
+	if name := strings.TrimPrefix(u.Path, "/"); name != "" {
+		room = Room("#" + name)
+	}
+	return newConsoleConn(os.Stdin, os.Stdout, Person(from), room, messageChan), nil
+}
+
+func newConsoleConn(r io.Reader, w io.Writer, from Person, room Room, messageChan chan<- *Message) *ConsoleConn {
+	c := &ConsoleConn{messageChan: messageChan, from: from, room: room, w: w}
+	go c.readloop(r)
+	return c
+}
+
+func (c *ConsoleConn) readloop(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		c.messageChan <- &Message{
+			Conn:    c,
+			From:    c.from,
+			Room:    c.room,
+			RawText: text,
+			Text:    text,
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("console: %v", err)
+	}
+}
+
+func (c *ConsoleConn) printf(format string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.w, StripFormatting(fmt.Sprintf(format, args...)))
+	return err
+}
+
+func (c *ConsoleConn) Send(to Person, message string) error {
+	return c.printf("-> %s: %s\n", to, message)
+}
+
+func (c *ConsoleConn) Respond(m *Message, response string) error {
+	if m.Room != "" {
+		return c.printf("-> %s: %s: %s\n", m.Room, m.From, response)
+	}
+	return c.Send(m.From, response)
+}
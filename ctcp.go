@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ctcpVersion is the reply to a CTCP VERSION request.
+const ctcpVersion = "magicalbot (github.com/magical/chat)"
+
+// splitCTCP picks apart a CTCP message, \x01COMMAND args\x01.
+// The closing \x01 is optional, since some clients leave it off.
+func splitCTCP(text string) (command, args string, ok bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+	text = strings.TrimSuffix(text[1:], "\x01")
+	command = text
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		command, args = text[:i], text[i+1:]
+	}
+	return strings.ToUpper(command), args, command != ""
+}
+
+// ctcpReply returns the automatic reply to a CTCP request,
+// or false if the request isn't one we answer.
+func ctcpReply(command, args string, now time.Time) (string, bool) {
+	switch command {
+	case "VERSION":
+		return ctcpVersion, true
+	case "PING":
+		return args, true
+	case "TIME":
+		return now.Format(time.RFC1123Z), true
+	case "CLIENTINFO":
+		return "ACTION CLIENTINFO PING TIME VERSION", true
+	}
+	return "", false
+}
+
+// A rateLimiter allows bursts of up to burst events,
+// refilled at one every interval.
+type rateLimiter struct {
+	burst int
+	every time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether an event may happen now, and counts it if so.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = float64(l.burst)
+	} else {
+		l.tokens += float64(now.Sub(l.last)) / float64(l.every)
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,49 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitCTCP(t *testing.T) {
+	tests := []struct {
+		text          string
+		command, args string
+		ok            bool
+	}{
+		{"\x01ACTION waves\x01", "ACTION", "waves", true},
+		{"\x01action waves at bob", "ACTION", "waves at bob", true},
+		{"\x01VERSION\x01", "VERSION", "", true},
+		{"\x01PING 12345\x01", "PING", "12345", true},
+		{"\x01\x01", "", "", false},
+		{"hello", "", "", false},
+	}
+	for _, tt := range tests {
+		command, args, ok := splitCTCP(tt.text)
+		if command != tt.command || args != tt.args || ok != tt.ok {
+			t.Errorf("splitCTCP(%q) = %q, %q, %v; want %q, %q, %v", tt.text, command, args, ok, tt.command, tt.args, tt.ok)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := rateLimiter{burst: 3, every: 2 * time.Second}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.allow(now) {
+			t.Fatalf("event %d of the burst was not allowed", i)
+		}
+	}
+	if l.allow(now) {
+		t.Error("allowed an event past the burst")
+	}
+	if l.allow(now.Add(time.Second)) {
+		t.Error("allowed an event before the interval was up")
+	}
+	if !l.allow(now.Add(2 * time.Second)) {
+		t.Error("didn't allow an event after the interval")
+	}
+	if !l.allow(now.Add(time.Hour)) || !l.allow(now.Add(time.Hour)) || !l.allow(now.Add(time.Hour)) || l.allow(now.Add(time.Hour)) {
+		t.Error("burst didn't refill to exactly 3")
+	}
+}
@@ -0,0 +1,621 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiscordConn is a connection to Discord as a bot user.
+//
+// Events arrive over the gateway, a WebSocket, and messages are sent
+// with the REST API. Guild channels are Rooms and users are Persons,
+// both by their Discord IDs. Direct messages have no Room.
+type DiscordConn struct {
+	token       string
+	api         string // base URL of the REST API
+	intents     int
+	dialer      Dialer
+	client      *http.Client
+	messageChan chan<- *Message
+
+	userID  string // the bot's own user ID
+	gateway string // gateway URL for new sessions
+
+	bmu     sync.Mutex
+	buckets map[string]*discordBucket // rate limits, by route
+
+	mu        sync.Mutex
+	ws        *wsConn
+	closed    bool
+	session   string // session ID, for resuming
+	resumeURL string
+	seq       int64             // last sequence number received
+	acked     bool              // whether the last heartbeat was acknowledged
+	channels  map[string]bool   // guild channels we know about
+	dms       map[string]string // user ID -> direct message channel ID
+}
+
+const discordAPI = "https://discord.com/api/v10/"
+
+// Default gateway intents: guilds, guild messages, direct messages
+// and message content.
+const discordIntents = 1<<0 | 1<<9 | 1<<12 | 1<<15
+
+// discordMaxRetries is how many times a rate-limited request is retried.
+const discordMaxRetries = 3
+
+// Gateway opcodes.
+const (
+	discordDispatch       = 0
+	discordHeartbeat      = 1
+	discordIdentify       = 2
+	discordResume         = 6
+	discordReconnect      = 7
+	discordInvalidSession = 9
+	discordHello          = 10
+	discordHeartbeatACK   = 11
+)
+
+// discordResumeCode is the close status we use when we mean to resume.
+// Closing with 1000 or 1001 would end the session.
+const discordResumeCode = 4000
+
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d,omitempty"`
+	S  int64           `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+// discordBucket tracks the rate limit for a route.
+// Requests on a route are made one at a time.
+type discordBucket struct {
+	mu        sync.Mutex
+	remaining int
+	reset     time.Time
+}
+
+// discordFatal reports whether a gateway close code means
+// reconnecting won't help, such as a bad token.
+func discordFatal(code int) bool {
+	switch code {
+	case 4004, 4010, 4011, 4012, 4013, 4014:
+		return true
+	}
+	return false
+}
+
+func init() {
+	RegisterScheme("discord", func(rawurl string, messageChan chan<- *Message) (Conn, error) {
+		c, err := DialDiscord(rawurl, messageChan)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+// DialDiscord connects to Discord. The URL gives the bot token:
+//
+//	discord://BOT_TOKEN@discord.com
+//
+// The intents parameter overrides the gateway intents,
+// the proxy parameter names a proxy to connect through (see ProxyDialer),
+// and the api parameter overrides the REST API's base URL, for testing.
+func DialDiscord(rawurl string, messageChan chan<- *Message) (*DiscordConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "discord" {
+		return nil, errors.New("DialDiscord: scheme must be discord://")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("DialDiscord: missing bot token")
+	}
+	q := u.Query()
+	dialer, err := dialerFor(q)
+	if err != nil {
+		return nil, err
+	}
+	c := &DiscordConn{
+		token:       u.User.Username(),
+		api:         q.Get("api"),
+		intents:     discordIntents,
+		dialer:      dialer,
+		client:      httpClient(dialer, 30*time.Second),
+		messageChan: messageChan,
+		buckets:     make(map[string]*discordBucket),
+		channels:    make(map[string]bool),
+		dms:         make(map[string]string),
+	}
+	if c.api == "" {
+		c.api = discordAPI
+	}
+	if !strings.HasSuffix(c.api, "/") {
+		c.api += "/"
+	}
+	if s := q.Get("intents"); s != "" {
+		if c.intents, err = strconv.Atoi(s); err != nil {
+			return nil, fmt.Errorf("DialDiscord: bad intents: %v", err)
+		}
+	}
+
+	var me struct {
+		ID string `json:"id"`
+	}
+	if err := c.request("GET", "users/@me", nil, &me); err != nil {
+		return nil, err
+	}
+	c.userID = me.ID
+	var gw struct {
+		URL string `json:"url"`
+	}
+	if err := c.request("GET", "gateway/bot", nil, &gw); err != nil {
+		return nil, err
+	}
+	c.gateway = gw.URL
+
+	ws, err := c.openGateway()
+	if err != nil {
+		return nil, err
+	}
+	go c.gatewayLoop(ws)
+	return c, nil
+}
+
+// request makes a REST API request, waiting out the route's rate limit
+// and retrying if it is rate limited anyway.
+// The result, if not nil, is decoded from the response.
+func (c *DiscordConn) request(method, path string, params, result interface{}) error {
+	var body []byte
+	if params != nil {
+		var err error
+		if body, err = json.Marshal(params); err != nil {
+			return err
+		}
+	}
+	route := method + " " + path
+	c.bmu.Lock()
+	b := c.buckets[route]
+	if b == nil {
+		b = &discordBucket{remaining: 1}
+		c.buckets[route] = b
+	}
+	c.bmu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for try := 0; ; try++ {
+		if b.remaining <= 0 {
+			if wait := time.Until(b.reset); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		req, err := http.NewRequest(method, c.api+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if params != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bot "+c.token)
+		req.Header.Set("User-Agent", "DiscordBot (https://github.com/magical/chat, 1)")
+		resp, err := c.client.Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		b.remaining = 1
+		if s := resp.Header.Get("X-RateLimit-Remaining"); s != "" {
+			b.remaining, _ = strconv.Atoi(s)
+		}
+		if s := resp.Header.Get("X-RateLimit-Reset-After"); s != "" {
+			secs, _ := strconv.ParseFloat(s, 64)
+			b.reset = time.Now().Add(time.Duration(secs * float64(time.Second)))
+		}
+		if resp.StatusCode == http.StatusTooManyRequests && try < discordMaxRetries {
+			var limit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.Unmarshal(data, &limit)
+			wait := time.Duration(limit.RetryAfter * float64(time.Second))
+			log.Printf("discord: %s rate limited; retrying in %v", route, wait)
+			time.Sleep(wait)
+			continue
+		}
+		if resp.StatusCode/100 != 2 {
+			var derr struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(data, &derr)
+			if derr.Message != "" {
+				return fmt.Errorf("discord: %s: %s", route, derr.Message)
+			}
+			return fmt.Errorf("discord: %s: %s", route, resp.Status)
+		}
+		if result != nil {
+			return json.Unmarshal(data, result)
+		}
+		return nil
+	}
+}
+
+// openGateway connects to the gateway, resuming our session if we have one.
+func (c *DiscordConn) openGateway() (*wsConn, error) {
+	c.mu.Lock()
+	addr := c.gateway
+	if c.session != "" && c.resumeURL != "" {
+		addr = c.resumeURL
+	}
+	c.mu.Unlock()
+	ws, err := dialWebsocket(addr+"?v=10&encoding=json", nil, c.dialer)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		ws.Close()
+		return nil, errors.New("discord: connection closed")
+	}
+	c.ws = ws
+	return ws, nil
+}
+
+// gatewayLoop reads events from the gateway, reconnecting
+// whenever Discord asks it to or the connection drops.
+func (c *DiscordConn) gatewayLoop(ws *wsConn) {
+	backoff := time.Second
+	for {
+		err := c.readGateway(ws)
+		ws.CloseWith(discordResumeCode)
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		if cerr, ok := err.(*wsCloseError); ok && discordFatal(cerr.Code) {
+			log.Printf("discord: %v; giving up", err)
+			return
+		}
+		if err != nil {
+			log.Printf("discord: %v; reconnecting", err)
+		}
+		for {
+			ws, err = c.openGateway()
+			if err == nil {
+				backoff = time.Second
+				break
+			}
+			c.mu.Lock()
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Printf("discord: reconnecting: %v", err)
+			time.Sleep(backoff)
+			if backoff < 5*time.Minute {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+func (c *DiscordConn) sendPayload(ws *wsConn, op int, d interface{}) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return ws.WriteJSON(discordPayload{Op: op, D: data})
+}
+
+// readGateway handles gateway messages until the connection ends.
+// It returns nil if Discord asked us to reconnect.
+func (c *DiscordConn) readGateway(ws *wsConn) error {
+	var p discordPayload
+	if err := ws.ReadJSON(&p); err != nil {
+		return err
+	}
+	if p.Op != discordHello {
+		return fmt.Errorf("expected hello, got op %d", p.Op)
+	}
+	var hello struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	if err := json.Unmarshal(p.D, &hello); err != nil {
+		return err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	c.mu.Lock()
+	c.acked = true
+	c.mu.Unlock()
+	go c.heartbeat(ws, time.Duration(hello.HeartbeatInterval)*time.Millisecond, stop)
+
+	if err := c.identify(ws); err != nil {
+		return err
+	}
+	for {
+		var p discordPayload
+		if err := ws.ReadJSON(&p); err != nil {
+			return err
+		}
+		switch p.Op {
+		case discordDispatch:
+			c.mu.Lock()
+			if p.S > c.seq {
+				c.seq = p.S
+			}
+			c.mu.Unlock()
+			c.dispatch(p.T, p.D)
+		case discordHeartbeat:
+			c.sendHeartbeat(ws)
+		case discordHeartbeatACK:
+			c.mu.Lock()
+			c.acked = true
+			c.mu.Unlock()
+		case discordReconnect:
+			return nil
+		case discordInvalidSession:
+			var resumable bool
+			json.Unmarshal(p.D, &resumable)
+			if !resumable {
+				c.mu.Lock()
+				c.session = ""
+				c.seq = 0
+				c.mu.Unlock()
+			}
+			// Discord asks for a short random wait before identifying again
+			time.Sleep(time.Duration(1+rand.Intn(4)) * time.Second)
+			if err := c.identify(ws); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// identify starts a new session, or resumes the old one.
+func (c *DiscordConn) identify(ws *wsConn) error {
+	c.mu.Lock()
+	session, seq := c.session, c.seq
+	c.mu.Unlock()
+	if session != "" {
+		return c.sendPayload(ws, discordResume, map[string]interface{}{
+			"token":      c.token,
+			"session_id": session,
+			"seq":        seq,
+		})
+	}
+	return c.sendPayload(ws, discordIdentify, map[string]interface{}{
+		"token":   c.token,
+		"intents": c.intents,
+		"properties": map[string]string{
+			"os":      runtime.GOOS,
+			"browser": "magicalbot",
+			"device":  "magicalbot",
+		},
+	})
+}
+
+// heartbeat sends heartbeats until stop is closed. If Discord stops
+// acknowledging them, the connection is dropped so that it can be resumed.
+func (c *DiscordConn) heartbeat(ws *wsConn, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	// the first heartbeat is jittered, so that clients don't all beat at once
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(interval))))
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		acked := c.acked
+		c.acked = false
+		c.mu.Unlock()
+		if !acked {
+			log.Printf("discord: heartbeat not acknowledged")
+			ws.CloseWith(discordResumeCode)
+			return
+		}
+		c.sendHeartbeat(ws)
+		t.Reset(interval)
+	}
+}
+
+// sendHeartbeat sends the last sequence number we received, if any.
+func (c *DiscordConn) sendHeartbeat(ws *wsConn) error {
+	c.mu.Lock()
+	seq := c.seq
+	c.mu.Unlock()
+	var d interface{}
+	if seq != 0 {
+		d = seq
+	}
+	return c.sendPayload(ws, discordHeartbeat, d)
+}
+
+type discordMessage struct {
+	ChannelID string `json:"channel_id"`
+	GuildID   string `json:"guild_id"`
+	Author    struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+		Bot      bool   `json:"bot"`
+	} `json:"author"`
+	Content  string `json:"content"`
+	Mentions []struct {
+		ID string `json:"id"`
+	} `json:"mentions"`
+}
+
+func (c *DiscordConn) dispatch(event string, d json.RawMessage) {
+	switch event {
+	case "READY":
+		var ready struct {
+			SessionID string `json:"session_id"`
+			ResumeURL string `json:"resume_gateway_url"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}
+		json.Unmarshal(d, &ready)
+		c.mu.Lock()
+		c.session = ready.SessionID
+		c.resumeURL = ready.ResumeURL
+		c.mu.Unlock()
+		log.Printf("discord: connected as %s", ready.User.ID)
+	case "RESUMED":
+		log.Printf("discord: resumed session")
+	case "GUILD_CREATE":
+		var guild struct {
+			Channels []struct {
+				ID string `json:"id"`
+			} `json:"channels"`
+		}
+		json.Unmarshal(d, &guild)
+		c.mu.Lock()
+		for _, ch := range guild.Channels {
+			c.channels[ch.ID] = true
+		}
+		c.mu.Unlock()
+	case "MESSAGE_CREATE":
+		var msg discordMessage
+		if err := json.Unmarshal(d, &msg); err != nil {
+			log.Printf("discord: bad message: %v", err)
+			return
+		}
+		c.handleMessage(&msg)
+	}
+}
+
+// handleMessage turns a Discord message into a Message.
+func (c *DiscordConn) handleMessage(msg *discordMessage) {
+	if msg.Author.Bot || msg.Author.ID == c.userID {
+		return
+	}
+	var m Message
+	m.Conn = c
+	m.From = Person(msg.Author.ID)
+	m.Sender = Sender{Nick: msg.Author.Username, Account: msg.Author.ID}
+	c.mu.Lock()
+	if msg.GuildID != "" {
+		m.Room = Room(msg.ChannelID)
+		c.channels[msg.ChannelID] = true
+	} else {
+		c.dms[msg.Author.ID] = msg.ChannelID
+	}
+	c.mu.Unlock()
+	m.RawText = msg.Content
+	m.Text = msg.Content
+	for _, u := range msg.Mentions {
+		if u.ID == c.userID {
+			m.To = Person(c.userID)
+		}
+	}
+	// strip a leading mention, in either form
+	for _, mention := range []string{"<@" + c.userID + ">", "<@!" + c.userID + ">"} {
+		if strings.HasPrefix(m.Text, mention) {
+			m.Text = strings.TrimLeft(strings.TrimPrefix(m.Text, mention), ":, ")
+			m.To = Person(c.userID)
+		}
+	}
+	c.messageChan <- &m
+}
+
+// channel returns the channel to send to for to, which is either
+// a channel or a user. A user gets a direct message channel.
+func (c *DiscordConn) channel(to Person) (string, error) {
+	id := string(to)
+	c.mu.Lock()
+	dm, isDM := c.dms[id]
+	known := c.channels[id]
+	c.mu.Unlock()
+	if isDM {
+		return dm, nil
+	}
+	if known {
+		return id, nil
+	}
+	var ch struct {
+		ID string `json:"id"`
+	}
+	if err := c.request("POST", "users/@me/channels", map[string]string{"recipient_id": id}, &ch); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.dms[id] = ch.ID
+	c.mu.Unlock()
+	return ch.ID, nil
+}
+
+// post sends text to a channel. If mention is set, the message starts
+// by mentioning that user, and nobody else can be pinged by it.
+func (c *DiscordConn) post(channel, mention, text string) error {
+	content := discordMarkdown.render(text)
+	users := []string{}
+	if mention != "" {
+		content = "<@" + mention + "> " + content
+		users = append(users, mention)
+	}
+	params := map[string]interface{}{
+		"content":          content,
+		"allowed_mentions": map[string]interface{}{"parse": []string{}, "users": users},
+	}
+	err := c.request("POST", "channels/"+channel+"/messages", params, nil)
+	if err != nil {
+		log.Printf("discord: %v", err)
+	}
+	return err
+}
+
+// Send sends a message to a channel, or directly to a user.
+func (c *DiscordConn) Send(to Person, message string) error {
+	channel, err := c.channel(to)
+	if err != nil {
+		return err
+	}
+	return c.post(channel, "", message)
+}
+
+// Respond replies to m in the same channel,
+// mentioning the sender if it was in a guild channel.
+func (c *DiscordConn) Respond(m *Message, response string) error {
+	if m.Room != "" {
+		return c.post(string(m.Room), string(m.From), response)
+	}
+	return c.Send(m.From, response)
+}
+
+// Close disconnects from the gateway.
+func (c *DiscordConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.ws != nil {
+		return c.ws.Close()
+	}
+	return nil
+}
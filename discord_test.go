@@ -0,0 +1,292 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDiscord is a stand-in for Discord's gateway and REST API.
+type fakeDiscord struct {
+	*httptest.Server
+	t *testing.T
+
+	mu      sync.Mutex
+	posts   []discordPost
+	limited int  // how many more posts to answer with 429
+	empty   bool // whether the next post to C1 empties its bucket
+	seq     int64
+	ws      *wsConn
+
+	logins   chan discordPayload // identify and resume payloads
+	beats    chan int64          // sequence numbers from heartbeats
+	dispatch chan discordPayload // events to send to the client
+}
+
+type discordPost struct {
+	channel, content string
+	mentions         []string // who may be pinged
+	at               time.Time
+}
+
+func newFakeDiscord(t *testing.T) *fakeDiscord {
+	f := &fakeDiscord{
+		t:        t,
+		logins:   make(chan discordPayload, 10),
+		beats:    make(chan int64, 100),
+		dispatch: make(chan discordPayload, 10),
+	}
+	authed := func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Authorization") != "Bot tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"401: Unauthorized","code":0}`)
+			return false
+		}
+		return true
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		if authed(w, r) {
+			fmt.Fprint(w, `{"id":"BOT","username":"magicalbot","bot":true}`)
+		}
+	})
+	mux.HandleFunc("/api/gateway/bot", func(w http.ResponseWriter, r *http.Request) {
+		if authed(w, r) {
+			fmt.Fprintf(w, `{"url":"ws://%s/gateway"}`, r.Host)
+		}
+	})
+	mux.HandleFunc("/api/users/@me/channels", func(w http.ResponseWriter, r *http.Request) {
+		if authed(w, r) {
+			fmt.Fprint(w, `{"id":"D9","type":1}`)
+		}
+	})
+	mux.HandleFunc("/api/channels/", func(w http.ResponseWriter, r *http.Request) {
+		if !authed(w, r) {
+			return
+		}
+		channel := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/channels/"), "/")[0]
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.limited > 0 {
+			f.limited--
+			w.WriteHeader(http.StatusTooManyRequests)
+			fmt.Fprint(w, `{"message":"You are being rate limited.","retry_after":0.01,"global":false}`)
+			return
+		}
+		var params struct {
+			Content         string
+			AllowedMentions *struct {
+				Parse []string
+				Users []string
+			} `json:"allowed_mentions"`
+		}
+		json.NewDecoder(r.Body).Decode(&params)
+		var mentions []string
+		if params.AllowedMentions == nil || len(params.AllowedMentions.Parse) > 0 {
+			mentions = []string{"everyone"}
+		} else {
+			mentions = params.AllowedMentions.Users
+		}
+		f.posts = append(f.posts, discordPost{channel, params.Content, mentions, time.Now()})
+		if channel == "C1" && f.empty {
+			f.empty = false
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset-After", "0.3")
+		}
+		fmt.Fprint(w, `{"id":"M1"}`)
+	})
+	gateway := func(w http.ResponseWriter, r *http.Request) {
+		ws, err := acceptWebsocket(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		f.mu.Lock()
+		f.ws = ws
+		f.mu.Unlock()
+		ws.WriteJSON(map[string]interface{}{"op": discordHello, "d": map[string]int{"heartbeat_interval": 50}})
+		done := make(chan bool)
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case p, ok := <-f.dispatch:
+					if !ok {
+						return
+					}
+					f.send(ws, p.T, p.D)
+				case <-done:
+					return
+				}
+			}
+		}()
+		for {
+			var p discordPayload
+			if err := ws.ReadJSON(&p); err != nil {
+				return
+			}
+			switch p.Op {
+			case discordHeartbeat:
+				var seq int64
+				json.Unmarshal(p.D, &seq)
+				select {
+				case f.beats <- seq:
+				default:
+				}
+				ws.WriteJSON(map[string]int{"op": discordHeartbeatACK})
+			case discordIdentify:
+				f.logins <- p
+				f.send(ws, "READY", json.RawMessage(fmt.Sprintf(
+					`{"session_id":"sess","resume_gateway_url":"ws://%s/resume","user":{"id":"BOT"}}`, r.Host)))
+				f.send(ws, "GUILD_CREATE", json.RawMessage(`{"id":"G1","channels":[{"id":"C1"},{"id":"C2"}]}`))
+			case discordResume:
+				f.logins <- p
+				f.send(ws, "RESUMED", nil)
+			}
+		}
+	}
+	mux.HandleFunc("/gateway", gateway)
+	mux.HandleFunc("/resume", gateway)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// send sends a dispatch event with the next sequence number.
+func (f *fakeDiscord) send(ws *wsConn, event string, d json.RawMessage) {
+	f.mu.Lock()
+	f.seq++
+	seq := f.seq
+	f.mu.Unlock()
+	ws.WriteJSON(discordPayload{Op: discordDispatch, T: event, S: seq, D: d})
+}
+
+// drop closes the gateway connection without a close frame.
+func (f *fakeDiscord) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ws.conn.Close()
+}
+
+func (f *fakeDiscord) lastPost() discordPost {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.posts) == 0 {
+		return discordPost{}
+	}
+	return f.posts[len(f.posts)-1]
+}
+
+func (f *fakeDiscord) login(t *testing.T) discordPayload {
+	select {
+	case p := <-f.logins:
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatal("client didn't identify")
+		return discordPayload{}
+	}
+}
+
+func TestDiscord(t *testing.T) {
+	f := newFakeDiscord(t)
+	defer f.Close()
+	defer close(f.dispatch)
+	messages := make(chan *Message, 10)
+	c, err := DialDiscord("discord://tok@discord.com?api="+f.URL+"/api/", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p := f.login(t)
+	var identify struct {
+		Token   string
+		Intents int
+	}
+	json.Unmarshal(p.D, &identify)
+	if p.Op != discordIdentify || identify.Token != "tok" || identify.Intents != discordIntents {
+		t.Errorf("identified with %s", p.D)
+	}
+
+	message := func(d string) discordPayload {
+		return discordPayload{T: "MESSAGE_CREATE", D: json.RawMessage(d)}
+	}
+	// the bot's own messages are ignored
+	f.dispatch <- message(`{"channel_id":"C1","guild_id":"G1","author":{"id":"BOT","bot":true},"content":"hello"}`)
+	f.dispatch <- message(`{"channel_id":"C1","guild_id":"G1","author":{"id":"U1"},"content":"<@!BOT> start","mentions":[{"id":"BOT"}]}`)
+	m := receive(t, messages)
+	if m.Room != "C1" || m.From != "U1" || m.Text != "start" || m.To != "BOT" {
+		t.Errorf("got message %+v", m)
+	}
+
+	// a 429 is retried; an emptied bucket holds up that route only
+	f.mu.Lock()
+	f.limited = 1
+	f.empty = true
+	f.mu.Unlock()
+	if err := c.Respond(m, "okay"); err != nil {
+		t.Fatal(err)
+	}
+	first := f.lastPost()
+	if first.channel != "C1" || first.content != "<@U1> okay" || strings.Join(first.mentions, " ") != "U1" {
+		t.Errorf("posted %+v", first)
+	}
+	c.Send("C2", "elsewhere")
+	if p := f.lastPost(); p.channel != "C2" || p.at.Sub(first.at) > 200*time.Millisecond {
+		t.Errorf("posted %+v, %v after the first", p, p.at.Sub(first.at))
+	}
+	c.Send("C1", "again")
+	if p := f.lastPost(); p.channel != "C1" || p.at.Sub(first.at) < 250*time.Millisecond {
+		t.Errorf("posted %+v only %v after the bucket emptied", p, p.at.Sub(first.at))
+	}
+
+	// heartbeats carry the last sequence number
+	deadline := time.After(5 * time.Second)
+	for seq := int64(0); seq < 4; {
+		select {
+		case seq = <-f.beats:
+		case <-deadline:
+			t.Fatalf("last heartbeat had sequence %d, want 4", seq)
+		}
+	}
+
+	// after the connection drops, the session is resumed
+	f.drop()
+	p = f.login(t)
+	var resume struct {
+		SessionID string `json:"session_id"`
+		Seq       int64
+	}
+	json.Unmarshal(p.D, &resume)
+	if p.Op != discordResume || resume.SessionID != "sess" || resume.Seq != 4 {
+		t.Errorf("resumed with op %d %s", p.Op, p.D)
+	}
+
+	f.dispatch <- message(`{"channel_id":"D1","author":{"id":"U2"},"content":"hand"}`)
+	m = receive(t, messages)
+	if m.Room != "" || m.From != "U2" || m.Text != "hand" || m.To != "" {
+		t.Errorf("got %+v, want a direct message", m)
+	}
+	c.Respond(m, "your cards")
+	if p := f.lastPost(); p.channel != "D1" || p.content != "your cards" || len(p.mentions) != 0 {
+		t.Errorf("posted %+v", p)
+	}
+	c.Send("U3", "hi")
+	if p := f.lastPost(); p.channel != "D9" {
+		t.Errorf("posted %+v, want a new direct message channel", p)
+	}
+}
+
+func TestDiscordBadToken(t *testing.T) {
+	f := newFakeDiscord(t)
+	defer f.Close()
+	_, err := DialDiscord("discord://wrong@discord.com?api="+f.URL+"/api/", nil)
+	if err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("DialDiscord with a bad token: err = %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package chat
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Text sent through the bot may be formatted with mIRC control codes,
+// which are easiest made with Bold, Italic, Underline and Colored.
+// IRC connections send them as they are; other backends render them
+// in their own markup, or strip them.
+//
+// Formatting in received text is parsed into Message.Spans.
+
+// A Color is one of the mIRC colors.
+type Color int
+
+const (
+	White Color = iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Purple
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+
+	NoColor Color = -1 // the client's default
+)
+
+// colorHex approximates the first 16 colors for backends which use RGB.
+var colorHex = [...]string{
+	"#FFFFFF", "#000000", "#00007F", "#009300",
+	"#FF0000", "#7F0000", "#9C009C", "#FC7F00",
+	"#FFFF00", "#00FC00", "#009393", "#00FFFF",
+	"#0000FC", "#FF00FF", "#7F7F7F", "#D2D2D2",
+}
+
+// Style is how a piece of text is formatted.
+type Style struct {
+	Bold, Italic, Underline bool
+	Fg, Bg                  Color
+}
+
+var plainStyle = Style{Fg: NoColor, Bg: NoColor}
+
+// A Span is a run of text in one style.
+type Span struct {
+	Style
+	Text string
+}
+
+// Bold returns s in bold.
+func Bold(s string) string { return "\x02" + s + "\x02" }
+
+// Italic returns s in italics.
+func Italic(s string) string { return "\x1d" + s + "\x1d" }
+
+// Underline returns s underlined.
+func Underline(s string) string { return "\x1f" + s + "\x1f" }
+
+// Colored returns s in the color c.
+func Colored(c Color, s string) string {
+	if strings.HasPrefix(s, ",") {
+		// don't let it be read as a background color
+		s = "\x02\x02" + s
+	}
+	return fmt.Sprintf("\x03%02d%s\x03", c, s)
+}
+
+// hasFormatting reports whether s contains any control codes
+// which ParseFormatting understands.
+func hasFormatting(s string) bool {
+	return strings.ContainsAny(s, "\x02\x03\x0f\x11\x16\x1d\x1e\x1f")
+}
+
+// ParseFormatting splits text containing mIRC control codes
+// into spans of plain text. Reverse video, strikethrough and monospace
+// codes are dropped.
+func ParseFormatting(s string) []Span {
+	var spans []Span
+	st := plainStyle
+	start := 0
+	flush := func(end int) {
+		if start == end {
+			return
+		}
+		if n := len(spans); n > 0 && spans[n-1].Style == st {
+			spans[n-1].Text += s[start:end]
+		} else {
+			spans = append(spans, Span{st, s[start:end]})
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		code := s[i]
+		switch code {
+		case '\x02', '\x03', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		default:
+			continue
+		}
+		flush(i)
+		switch code {
+		case '\x02':
+			st.Bold = !st.Bold
+		case '\x1d':
+			st.Italic = !st.Italic
+		case '\x1f':
+			st.Underline = !st.Underline
+		case '\x0f':
+			st = plainStyle
+		case '\x03':
+			fg, n := parseColor(s[i+1:])
+			if n == 0 {
+				st.Fg, st.Bg = NoColor, NoColor
+				break
+			}
+			st.Fg = fg
+			i += n
+			if i+1 < len(s) && s[i+1] == ',' {
+				if bg, m := parseColor(s[i+2:]); m > 0 {
+					st.Bg = bg
+					i += 1 + m
+				}
+			}
+		}
+		start = i + 1
+	}
+	flush(len(s))
+	return spans
+}
+
+// parseColor reads a color number of one or two digits from the start of s,
+// returning the color and how many bytes it took.
+func parseColor(s string) (Color, int) {
+	n := 0
+	c := 0
+	for n < 2 && n < len(s) && '0' <= s[n] && s[n] <= '9' {
+		c = c*10 + int(s[n]-'0')
+		n++
+	}
+	if c == 99 {
+		return NoColor, n
+	}
+	return Color(c), n
+}
+
+// StripFormatting removes mIRC control codes from s.
+func StripFormatting(s string) string {
+	if !hasFormatting(s) {
+		return s
+	}
+	var b strings.Builder
+	for _, span := range ParseFormatting(s) {
+		b.WriteString(span.Text)
+	}
+	return b.String()
+}
+
+// markdown is a flavor of markdown, giving the markers for each style,
+// or "" for styles it lacks, and how to keep marker characters
+// in the text from being read as markup.
+type markdown struct {
+	bold, italic, underline string
+	escape                  *strings.Replacer
+}
+
+var (
+	// Slack has no escapes for markers; a zero-width space keeps one
+	// from pairing up with another. &, < and > must be entities,
+	// or else text like <!channel> would ping people.
+	slackMarkdown = markdown{bold: "*", italic: "_",
+		escape: strings.NewReplacer("*", "*\u200b", "_", "_\u200b", "~", "~\u200b",
+			"&", "&amp;", "<", "&lt;", ">", "&gt;")}
+	discordMarkdown = markdown{bold: "**", italic: "_", underline: "__",
+		escape: strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`, "~", `\~`)}
+)
+
+// render converts the control codes in s to markdown,
+// escaping anything in the text which would be read as markup.
+// Colors are dropped.
+func (md markdown) render(s string) string {
+	if !hasFormatting(s) {
+		return md.escape.Replace(s)
+	}
+	spans := ParseFormatting(s)
+	var b strings.Builder
+	for i := 0; i < len(spans); {
+		// join up spans which only differ in color
+		var open, close string
+		st := spans[i].Style
+		if st.Bold && md.bold != "" {
+			open, close = open+md.bold, md.bold+close
+		}
+		if st.Italic && md.italic != "" {
+			open, close = open+md.italic, md.italic+close
+		}
+		if st.Underline && md.underline != "" {
+			open, close = open+md.underline, md.underline+close
+		}
+		text := spans[i].Text
+		for i++; i < len(spans) && sameMarkdown(md, st, spans[i].Style); i++ {
+			text += spans[i].Text
+		}
+		// markers only work next to the text they mark
+		trimmed := strings.TrimSpace(text)
+		if open == "" || trimmed == "" {
+			b.WriteString(md.escape.Replace(text))
+			continue
+		}
+		lead := strings.Index(text, trimmed)
+		b.WriteString(text[:lead])
+		b.WriteString(open + md.escape.Replace(trimmed) + close)
+		b.WriteString(text[lead+len(trimmed):])
+	}
+	return b.String()
+}
+
+func sameMarkdown(md markdown, a, b Style) bool {
+	return (a.Bold == b.Bold || md.bold == "") &&
+		(a.Italic == b.Italic || md.italic == "") &&
+		(a.Underline == b.Underline || md.underline == "")
+}
+
+// formatHTML converts the control codes in s to HTML.
+func formatHTML(s string) string {
+	var b strings.Builder
+	for _, span := range ParseFormatting(s) {
+		var open, close string
+		if span.Bold {
+			open, close = open+"<b>", "</b>"+close
+		}
+		if span.Italic {
+			open, close = open+"<i>", "</i>"+close
+		}
+		if span.Underline {
+			open, close = open+"<u>", "</u>"+close
+		}
+		if color := htmlColors(span.Style); color != "" {
+			open, close = open+"<font"+color+">", "</font>"+close
+		}
+		b.WriteString(open + html.EscapeString(span.Text) + close)
+	}
+	return b.String()
+}
+
+// htmlColors returns the attributes for a span's colors, as Matrix wants them.
+func htmlColors(st Style) string {
+	var attrs string
+	if 0 <= st.Fg && int(st.Fg) < len(colorHex) {
+		attrs += ` data-mx-color="` + colorHex[st.Fg] + `"`
+	}
+	if 0 <= st.Bg && int(st.Bg) < len(colorHex) {
+		attrs += ` data-mx-bg-color="` + colorHex[st.Bg] + `"`
+	}
+	return attrs
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFormatting(t *testing.T) {
+	bold := Style{Bold: true, Fg: NoColor, Bg: NoColor}
+	tests := []struct {
+		text  string
+		spans []Span
+	}{
+		{"plain", []Span{{plainStyle, "plain"}}},
+		{"a \x02bold\x02 word", []Span{{plainStyle, "a "}, {bold, "bold"}, {plainStyle, " word"}}},
+		{"\x02\x1d\x1fall\x0f none", []Span{
+			{Style{Bold: true, Italic: true, Underline: true, Fg: NoColor, Bg: NoColor}, "all"},
+			{plainStyle, " none"},
+		}},
+		{"\x034red\x03 \x0312,1blue on black", []Span{
+			{Style{Fg: Red, Bg: NoColor}, "red"},
+			{plainStyle, " "},
+			{Style{Fg: LightBlue, Bg: Black}, "blue on black"},
+		}},
+		{"\x0304,x", []Span{{Style{Fg: Red, Bg: NoColor}, ",x"}}},
+		{"\x03123", []Span{{Style{Fg: LightBlue, Bg: NoColor}, "3"}}},
+		{"\x0399default", []Span{{plainStyle, "default"}}},
+		{"a\x02\x02b", []Span{{plainStyle, "ab"}}},
+		{"\x16reversed\x16", []Span{{plainStyle, "reversed"}}},
+		{"\x02", nil},
+	}
+	for _, tt := range tests {
+		if got := ParseFormatting(tt.text); !reflect.DeepEqual(got, tt.spans) {
+			t.Errorf("ParseFormatting(%q) = %+v, want %+v", tt.text, got, tt.spans)
+		}
+	}
+}
+
+func TestFormatHelpers(t *testing.T) {
+	s := Bold("big") + " " + Italic("slanted") + " " + Underline("lined") + " " + Colored(Red, "5 apples") + Colored(Green, ",comma")
+	if got, want := StripFormatting(s), "big slanted lined 5 apples,comma"; got != want {
+		t.Errorf("StripFormatting = %q, want %q", got, want)
+	}
+	spans := ParseFormatting(s)
+	if !spans[0].Bold || !spans[2].Italic || !spans[4].Underline || spans[6].Fg != Red || spans[7].Fg != Green {
+		t.Errorf("spans = %+v", spans)
+	}
+}
+
+func TestRenderFormatting(t *testing.T) {
+	s := "the green card is " + Bold("Busy ") + Italic(Underline("really")) + " " + Colored(Red, "red")
+	tests := []struct {
+		md   markdown
+		want string
+	}{
+		{slackMarkdown, "the green card is *Busy* _really_ red"},
+		{discordMarkdown, "the green card is **Busy** ___really___ red"},
+	}
+	for _, tt := range tests {
+		if got := tt.md.render(s); got != tt.want {
+			t.Errorf("render(%q) = %q, want %q", s, got, tt.want)
+		}
+	}
+	// markup in the text is only text
+	if got, want := discordMarkdown.render("no *formatting* _here_"), `no \*formatting\* \_here\_`; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+	if got, want := discordMarkdown.render(Bold("2*3")+" ~ok~"), `**2\*3** \~ok\~`; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+	if got, want := slackMarkdown.render("*not bold*"), "*\u200bnot bold*\u200b"; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+	if got, want := slackMarkdown.render("<!channel> a<b & "+Bold("AT&T")), "&lt;!channel&gt; a&lt;b &amp; *AT&amp;T*"; got != want {
+		t.Errorf("render = %q, want %q", got, want)
+	}
+
+	want := `the green card is <b>Busy </b><i><u>really</u></i> <font data-mx-color="#FF0000">red</font>`
+	if got := formatHTML(s); got != want {
+		t.Errorf("formatHTML = %q, want %q", got, want)
+	}
+	if got := formatHTML(Bold("<b>")); got != "<b>&lt;b&gt;</b>" {
+		t.Errorf("formatHTML didn't escape: %q", got)
+	}
+}
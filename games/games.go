@@ -0,0 +1,622 @@
+// Package games provides the parts of a chat game which don't depend on
+// its rules: a lobby of players with a moderator, phases with timeouts,
+// public and private messages, and saving the game across restarts.
+//
+// A game supplies its rules by implementing Rules,
+// and is played at a Table, which is a chat.Handler.
+package games
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magical/chat"
+)
+
+// ErrUnknownCommand is returned by Rules.Command
+// for commands that the game doesn't recognize.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Rules are the part of a game which the Table doesn't handle.
+//
+// Rules methods are called with the table locked,
+// so they may call any Table methods except Event, Restore and Expire.
+// The table is saved after every call.
+type Rules interface {
+	// Start begins a new game with t.Players().
+	Start(t *Table) error
+
+	// Command handles a command that the table doesn't handle itself,
+	// sent either in the game's room or privately.
+	// It returns ErrUnknownCommand if it doesn't recognize cmd.
+	Command(t *Table, m *chat.Message, cmd, arg string) error
+
+	// Timeout is called when a phase set with SetPhase runs out of time.
+	Timeout(t *Table, phase string)
+
+	// Leave is called when p leaves a game in progress,
+	// after they have been removed from t.Players().
+	Leave(t *Table, p chat.Person)
+
+	// Stop is called when the game ends, whether it finished
+	// or was cut short, to announce the results and clean up.
+	Stop(t *Table)
+
+	// Status returns a short description of the game's progress.
+	Status(t *Table) string
+
+	// Resume reminds the room where the game is up to,
+	// after it has been paused or restored from the store.
+	Resume(t *Table)
+}
+
+// A Listener is Rules which want to see messages in the room
+// which aren't directed at the bot, such as answers to trivia questions.
+type Listener interface {
+	Hear(t *Table, m *chat.Message)
+}
+
+// A Table runs a game in a chat room.
+type Table struct {
+	Rules Rules
+
+	// Name, if set, must come before each of the table's commands,
+	// so that several games can share a room: "magicalbot: trivia start".
+	Name string
+
+	// Store, if not nil, is where the game is saved after every move
+	// so that it can be restored after a restart.
+	// The Rules are saved by marshaling them as JSON.
+	Store Store
+
+	// MinPlayers and MaxPlayers limit how many people can play.
+	// A MaxPlayers of zero means there is no limit.
+	// If MinPlayers is at most one, anyone can start a game
+	// without joining it first, and they become the moderator.
+	MinPlayers int
+	MaxPlayers int
+
+	// KeepPlayers is how many players a game in progress needs
+	// to go on when someone leaves; with fewer, it ends.
+	// Zero means MinPlayers. Rules which decide for themselves
+	// in Leave whether the game can go on should set it to one.
+	KeepPlayers int
+
+	// Identify returns a stable identity for the sender of a message.
+	// By default players are identified by their account,
+	// if they are logged in to one, and otherwise by nick.
+	Identify func(m *chat.Message) string
+
+	// Source, if not nil, is the source of randomness for the game,
+	// and the log notes that each game used it; whoever set it
+	// knows how it was seeded. Otherwise each game gets a new source
+	// seeded from the clock, and the seed is logged. Either way a
+	// disputed game can be replayed from the seed and the log of commands.
+	Source rand.Source
+
+	mu       sync.Mutex
+	bot      *chat.Bot
+	id       string // identifies the current game
+	room     chat.Room
+	conn     chat.Conn // the connection room is on, and players are on
+	connName string    // conn's name, for finding it after a restore
+	mod      chat.Person
+	players  []chat.Person
+	waiting  []chat.Person          // players who will join next round
+	ids      map[chat.Person]string // player identities
+	phase    string                 // "" when no game is in progress
+	paused   bool
+	resumed  bool // restored from the store but not yet announced
+	rand     *rand.Rand
+	seed     int64
+
+	// timing of the current phase
+	deadline  time.Time
+	remaining time.Duration // when paused or restored
+	timer     *time.Timer
+	timerGen  int
+
+	// where the last player to leave was, for NextPlayer
+	lastLeft  chat.Person
+	lastIndex int
+}
+
+// Table commands:
+// join - join the game, or the next round of the current game
+// leave - leave the game
+// start - start the game if enough people have joined
+// status - show the state of the game
+// kick nick - moderator removes someone from the game
+// pause, resume - moderator pauses or resumes the game
+// abort - moderator ends the game early
+
+// Event implements chat.Handler.
+func (t *Table) Event(b *chat.Bot, m *chat.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.bot = b
+	if c := t.connection(); c != nil && m.Conn != c {
+		// the same names on another connection are other people
+		return
+	}
+	if t.resumed && m.Room == t.room {
+		t.resume()
+	}
+	switch m.Kind {
+	case chat.KindPart:
+		if m.Room == t.room {
+			t.leave(m.From)
+			t.save()
+		}
+		return
+	case chat.KindQuit:
+		t.leave(m.From)
+		t.save()
+		return
+	case chat.KindMessage:
+	default:
+		return
+	}
+	if t.room != "" && m.Room != "" && m.Room != t.room {
+		return
+	}
+	if !directed(m) {
+		if l, ok := t.Rules.(Listener); ok && m.Room != "" && t.phase != "" {
+			l.Hear(t, m)
+			t.save()
+		}
+		return
+	}
+	text := strings.TrimSpace(strings.TrimPrefix(m.Text, "magicalbot:"))
+	cmd, arg := text, ""
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		cmd, arg = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	if t.Name != "" {
+		if cmd != t.Name {
+			return
+		}
+		cmd, arg = arg, ""
+		if i := strings.IndexByte(cmd, ' '); i >= 0 {
+			cmd, arg = cmd[:i], strings.TrimSpace(cmd[i+1:])
+		}
+	}
+	log.Printf("games: %s <%s> %s", m.Room, m.From, m.Text)
+	if err := t.command(m, cmd, arg); err == ErrUnknownCommand {
+		log.Printf("games: unknown command %q", cmd)
+	} else if err != nil {
+		t.Reply(m, err.Error())
+	}
+	t.save()
+}
+
+// Directed reports whether a message is directed at the bot
+func directed(m *chat.Message) bool {
+	return m.Room == "" || m.To != "" || strings.HasPrefix(m.Text, "magicalbot:") // lol
+}
+
+func (t *Table) command(m *chat.Message, cmd, arg string) error {
+	switch cmd {
+	case "join":
+		return t.join(m)
+	case "leave":
+		if !t.leave(m.From) {
+			return errors.New("you aren't playing")
+		}
+		return nil
+	case "start":
+		return t.start(m)
+	case "status":
+		t.Reply(m, t.status())
+		return nil
+	case "kick", "pause", "resume", "abort":
+		if t.phase == "" && cmd != "kick" {
+			return errors.New("there is no game in progress")
+		}
+		if !t.IsMod(m.From) {
+			return fmt.Errorf("only the moderator (%s) can do that", t.mod)
+		}
+		switch cmd {
+		case "kick":
+			p := chat.Person(arg)
+			if !t.leave(p) {
+				return fmt.Errorf("%s isn't playing", p)
+			}
+			if t.phase == "" {
+				t.Reply(m, "okay")
+			}
+		case "pause":
+			if t.paused {
+				return errors.New("the game is already paused")
+			}
+			t.pause()
+			t.Announce("the game is paused")
+		case "resume":
+			if !t.paused {
+				return errors.New("the game isn't paused")
+			}
+			t.unpause()
+			t.resume()
+		case "abort":
+			t.Announce("the game has been aborted")
+			t.End()
+		}
+		return nil
+	}
+	return t.Rules.Command(t, m, cmd, arg)
+}
+
+func (t *Table) join(m *chat.Message) error {
+	p := m.From
+	if t.Playing(p) {
+		return errors.New("you are already playing")
+	}
+	if t.ids == nil {
+		t.ids = make(map[chat.Person]string)
+	}
+	if t.phase != "" {
+		for _, q := range t.waiting {
+			if p == q {
+				return errors.New("you will join next round")
+			}
+		}
+		if t.full() {
+			return errors.New("the game is full")
+		}
+		t.waiting = append(t.waiting, p)
+		t.ids[p] = t.Identity(m)
+		t.Reply(m, "okay, you will join next round")
+		return nil
+	}
+	if t.full() {
+		return errors.New("the game is full")
+	}
+	t.seat(m)
+	t.Reply(m, "okay")
+	return nil
+}
+
+// seat adds the sender of m to the players in the lobby.
+// The first player becomes the moderator.
+func (t *Table) seat(m *chat.Message) {
+	if t.ids == nil {
+		t.ids = make(map[chat.Person]string)
+	}
+	if len(t.players) == 0 {
+		t.mod = m.From
+		t.room = m.Room
+		t.setConn(m.Conn)
+	}
+	t.players = append(t.players, m.From)
+	t.ids[m.From] = t.Identity(m)
+}
+
+func (t *Table) full() bool {
+	return t.MaxPlayers > 0 && len(t.players)+len(t.waiting) >= t.MaxPlayers
+}
+
+func (t *Table) start(m *chat.Message) error {
+	if t.phase != "" {
+		return errors.New("a game is already in progress")
+	}
+	if len(t.players) == 0 && t.MinPlayers <= 1 {
+		t.seat(m)
+	}
+	if len(t.players) < t.MinPlayers || len(t.players) == 0 {
+		return errors.New("need more players")
+	}
+	if m.Room != "" {
+		t.room = m.Room
+	}
+	if t.room == "" {
+		return errors.New("start the game in a room")
+	}
+	if t.conn == nil {
+		t.setConn(m.Conn)
+	}
+	if !t.Playing(t.mod) {
+		t.mod = t.players[0]
+	}
+	t.id = fmt.Sprintf("%s %s", time.Now().UTC().Format(time.RFC3339), t.room)
+	t.seedRand()
+	if t.Source == nil {
+		log.Printf("games: game %q: seed %d", t.id, t.seed)
+	} else {
+		log.Printf("games: game %q: using the table's own Source", t.id)
+	}
+	t.phase = "start"
+	if err := t.Rules.Start(t); err != nil {
+		t.stopTimer()
+		t.phase = ""
+		return err
+	}
+	return nil
+}
+
+// seedRand sets up the random number generator for a new game.
+func (t *Table) seedRand() {
+	if t.Source != nil {
+		if t.rand == nil {
+			t.rand = rand.New(t.Source)
+		}
+		return
+	}
+	t.seed = time.Now().UnixNano()
+	t.rand = rand.New(rand.NewSource(t.seed))
+}
+
+// leave removes p from the game and reports whether they were playing.
+func (t *Table) leave(p chat.Person) bool {
+	for i, q := range t.waiting {
+		if p == q {
+			t.waiting = append(t.waiting[:i], t.waiting[i+1:]...)
+			delete(t.ids, p)
+			return true
+		}
+	}
+	if !t.Playing(p) {
+		return false
+	}
+	wasMod := p == t.mod
+	t.removePlayer(p)
+	delete(t.ids, p)
+	if t.phase == "" {
+		return true
+	}
+	t.Announce(fmt.Sprintf("%s has left the game", p))
+	if wasMod && t.mod != "" {
+		t.Announce(fmt.Sprintf("%s is now the moderator", t.mod))
+	}
+	keep := t.KeepPlayers
+	if keep == 0 {
+		keep = t.MinPlayers
+	}
+	if len(t.players)+len(t.waiting) < keep || len(t.players) == 0 {
+		t.Announce("there aren't enough players left to continue")
+		t.End()
+		return true
+	}
+	t.Rules.Leave(t, p)
+	return true
+}
+
+// removePlayer removes p from the list of players.
+// If p was the moderator, the role passes to the next player.
+func (t *Table) removePlayer(p chat.Person) {
+	for i, q := range t.players {
+		if p == q {
+			if p == t.mod {
+				t.mod = ""
+				if len(t.players) > 1 {
+					t.mod = t.players[(i+1)%len(t.players)]
+				}
+			}
+			t.players = append(t.players[:i], t.players[i+1:]...)
+			t.lastLeft, t.lastIndex = p, i
+			return
+		}
+	}
+}
+
+// status returns a summary of the state of the game.
+func (t *Table) status() string {
+	if t.phase == "" {
+		if len(t.players) == 0 {
+			return "nobody has joined yet"
+		}
+		return fmt.Sprintf("waiting to start; %d joined: %s", len(t.players), Names(t.players))
+	}
+	s := t.Rules.Status(t)
+	if t.paused {
+		s += " (paused)"
+	}
+	if len(t.waiting) > 0 {
+		s += "; joining next round: " + Names(t.waiting)
+	}
+	return s
+}
+
+// resume announces a game which was restored from the store or unpaused.
+func (t *Table) resume() {
+	if t.resumed {
+		t.resumed = false
+		if !t.paused && t.remaining > 0 {
+			t.startTimer(t.remaining)
+			t.remaining = 0
+		}
+	}
+	t.Announce("the game has resumed!")
+	if t.paused {
+		t.Announce(fmt.Sprintf("the game is paused until %s says resume", t.mod))
+	}
+	t.Rules.Resume(t)
+}
+
+// End finishes the game. The rules' Stop method is called
+// to announce the results, and anyone waiting to join
+// is added to the players for the next game.
+func (t *Table) End() {
+	t.stopTimer()
+	t.Rules.Stop(t)
+	t.players = append(t.players, t.waiting...)
+	t.waiting = nil
+	t.paused = false
+	t.phase = ""
+	t.remaining = 0
+}
+
+// Admit adds players who are waiting to join to the game,
+// and returns the new players.
+func (t *Table) Admit() []chat.Person {
+	admitted := t.waiting
+	t.players = append(t.players, t.waiting...)
+	t.waiting = nil
+	return admitted
+}
+
+// Players returns the players in the game, in turn order.
+// The caller must not modify the returned slice.
+func (t *Table) Players() []chat.Person { return t.players }
+
+// Playing reports whether p is part of the current game.
+func (t *Table) Playing(p chat.Person) bool {
+	for _, q := range t.players {
+		if p == q {
+			return true
+		}
+	}
+	return false
+}
+
+// NextPlayer returns the player after p in turn order.
+// If p has just left the game, it returns whoever took their place.
+func (t *Table) NextPlayer(p chat.Person) chat.Person {
+	if len(t.players) == 0 {
+		return ""
+	}
+	for i, q := range t.players {
+		if p == q {
+			return t.players[(i+1)%len(t.players)]
+		}
+	}
+	if p == t.lastLeft {
+		return t.players[t.lastIndex%len(t.players)]
+	}
+	return t.players[0]
+}
+
+// IsMod reports whether p is the game's moderator.
+func (t *Table) IsMod(p chat.Person) bool { return p != "" && p == t.mod }
+
+// Mod returns the game's moderator, who is usually whoever joined first.
+func (t *Table) Mod() chat.Person { return t.mod }
+
+// Room returns the room where the game is being played.
+func (t *Table) Room() chat.Room { return t.room }
+
+// ID returns a string which identifies the current game.
+func (t *Table) ID() string { return t.id }
+
+// PlayerID returns the stable identity of player p.
+func (t *Table) PlayerID(p chat.Person) string {
+	if id := t.ids[p]; id != "" {
+		return id
+	}
+	return defaultIdentify(&chat.Message{From: p})
+}
+
+// Identity returns the stable identity of the sender of m.
+func (t *Table) Identity(m *chat.Message) string {
+	if t.Identify != nil {
+		return t.Identify(m)
+	}
+	return defaultIdentify(m)
+}
+
+// defaultIdentify identifies players by their account or nick.
+// Accounts are marked so that they can't be mistaken for nicks.
+// IRC nicks are case-insensitive.
+func defaultIdentify(m *chat.Message) string {
+	if m.Sender.Account != "" {
+		return "account:" + strings.ToLower(m.Sender.Account)
+	}
+	return strings.ToLower(string(m.From))
+}
+
+// Rand returns the random number generator for the current game.
+func (t *Table) Rand() *rand.Rand {
+	if t.rand == nil {
+		t.seedRand()
+	}
+	return t.rand
+}
+
+// Paused reports whether the moderator has paused the game.
+func (t *Table) Paused() bool { return t.paused }
+
+// setConn makes c the connection the game is played over.
+func (t *Table) setConn(c chat.Conn) {
+	t.conn = c
+	if t.bot != nil {
+		t.connName = t.bot.ConnName(c)
+	}
+}
+
+// connection returns the connection the game is played over,
+// or nil if it isn't known yet.
+func (t *Table) connection() chat.Conn {
+	if t.conn == nil && t.connName != "" && t.bot != nil {
+		// restored from the store
+		for _, ci := range t.bot.Conns() {
+			if ci.Name == t.connName {
+				t.conn = ci.Conn
+			}
+		}
+	}
+	return t.conn
+}
+
+// Announce sends a message to the game's room.
+func (t *Table) Announce(message string) {
+	if t.bot == nil {
+		log.Printf("games: no bot to announce %q", message)
+		return
+	}
+	if c := t.connection(); c != nil {
+		c.Send(chat.Person(t.room), message)
+		return
+	}
+	t.bot.SendRoom(t.room, message)
+}
+
+// Tell sends a private message to p, over the connection
+// the game is played on: someone by the same name elsewhere
+// is someone else.
+func (t *Table) Tell(p chat.Person, message string) {
+	if t.bot == nil {
+		log.Printf("games: no bot to tell %s %q", p, message)
+		return
+	}
+	if c := t.connection(); c != nil {
+		c.Send(p, message)
+		return
+	}
+	t.bot.Send(p, message)
+}
+
+// Notice sends p a notice, for things like hand listings
+// which are for reference rather than conversation.
+func (t *Table) Notice(p chat.Person, message string) {
+	if t.bot == nil {
+		log.Printf("games: no bot to send %s notice %q", p, message)
+		return
+	}
+	if c := t.connection(); c != nil {
+		t.bot.NoticeOn(c, p, message)
+		return
+	}
+	t.bot.Notice(p, message)
+}
+
+// Reply responds to m, publicly or privately, wherever it was sent.
+func (t *Table) Reply(m *chat.Message, message string) {
+	if t.bot == nil {
+		log.Printf("games: no bot to reply %q", message)
+		return
+	}
+	t.bot.Respond(m, message)
+}
+
+// Names returns a comma-separated list of people.
+func Names(people []chat.Person) string {
+	names := make([]string, len(people))
+	for i, p := range people {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,245 @@
+package games
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/internal/chattest"
+)
+
+// countdown is a game where players take turns saying "next",
+// and whoever's turn it is when the count reaches zero wins.
+type countdown struct {
+	Count int
+	Turn  chat.Person
+	Left  []chat.Person
+	Ended bool
+}
+
+func (c *countdown) Start(t *Table) error {
+	if c.Count <= 0 {
+		return errors.New("nothing to count")
+	}
+	c.Turn = t.Players()[0]
+	t.SetPhase("count", time.Hour)
+	return nil
+}
+
+func (c *countdown) Command(t *Table, m *chat.Message, cmd, arg string) error {
+	if cmd != "next" {
+		return ErrUnknownCommand
+	}
+	if t.Paused() {
+		return errors.New("the game is paused")
+	}
+	if m.From != c.Turn {
+		return errors.New("it isn't your turn")
+	}
+	c.next(t)
+	return nil
+}
+
+func (c *countdown) next(t *Table) {
+	c.Count--
+	if c.Count == 0 {
+		t.Announce(string(c.Turn) + " wins")
+		t.End()
+		return
+	}
+	c.Turn = t.NextPlayer(c.Turn)
+	t.SetPhase("count", time.Hour)
+}
+
+func (c *countdown) Timeout(t *Table, phase string) {
+	t.Announce(string(c.Turn) + " took too long")
+	c.next(t)
+}
+
+func (c *countdown) Leave(t *Table, p chat.Person) {
+	c.Left = append(c.Left, p)
+	if p == c.Turn {
+		c.Turn = t.NextPlayer(p)
+	}
+}
+
+func (c *countdown) Stop(t *Table)          { c.Ended = true }
+func (c *countdown) Status(t *Table) string { return string(c.Turn) + "'s turn" }
+func (c *countdown) Resume(t *Table)        { t.Announce(c.Status(t)) }
+
+func newTestTable(count int) (*Table, *countdown, func(from chat.Person, text string), *chattest.Conn) {
+	b, _ := chat.NewBot()
+	conn := new(chattest.Conn)
+	b.AddConn(conn)
+	c := &countdown{Count: count}
+	t := &Table{Rules: c, MinPlayers: 2, MaxPlayers: 3}
+	say := func(from chat.Person, text string) {
+		t.Event(b, &chat.Message{Conn: conn, From: from, Room: "#games", Text: "magicalbot: " + text})
+	}
+	return t, c, say, conn
+}
+
+func TestLobby(t *testing.T) {
+	tb, c, say, conn := newTestTable(5)
+	say("alice", "start")
+	if tb.Phase() != "" || !conn.Said("alice", "need more players") {
+		t.Errorf("started a game with nobody in it")
+	}
+	for _, p := range []chat.Person{"alice", "bob", "carol", "dave"} {
+		say(p, "join")
+	}
+	if tb.Playing("dave") || !conn.Said("dave", "the game is full") {
+		t.Errorf("dave joined a full game")
+	}
+	if tb.Mod() != "alice" || tb.Room() != "#games" {
+		t.Errorf("mod = %q, room = %q; want alice, #games", tb.Mod(), tb.Room())
+	}
+	say("bob", "kick carol")
+	if !tb.Playing("carol") {
+		t.Errorf("bob kicked carol, but isn't the moderator")
+	}
+	say("alice", "kick carol")
+	say("dave", "join")
+	say("alice", "start")
+	if tb.Phase() != "count" || c.Turn != "alice" {
+		t.Fatalf("phase = %q, turn = %q; want count, alice", tb.Phase(), c.Turn)
+	}
+	say("bob", "next")
+	if c.Count != 5 || !conn.Said("bob", "it isn't your turn") {
+		t.Errorf("bob moved out of turn")
+	}
+
+	// alice leaves on her turn; the moderator and the turn pass to bob
+	say("alice", "leave")
+	if tb.Mod() != "bob" || c.Turn != "bob" || len(c.Left) != 1 {
+		t.Errorf("after alice left: mod = %q, turn = %q", tb.Mod(), c.Turn)
+	}
+	say("eve", "join")
+	if tb.Playing("eve") || !conn.Said("eve", "next round") {
+		t.Errorf("eve should be waiting for the next round")
+	}
+	if tb.status() != "bob's turn; joining next round: eve" {
+		t.Errorf("status = %q", tb.status())
+	}
+	tb.Admit()
+	if got := Names(tb.Players()); got != "bob, dave, eve" {
+		t.Errorf("players = %s, want bob, dave, eve", got)
+	}
+
+	// too few players
+	tb.Event(nil, &chat.Message{Conn: conn, Kind: chat.KindQuit, From: "dave"})
+	tb.Event(nil, &chat.Message{Conn: conn, Kind: chat.KindPart, From: "eve", Room: "#games"})
+	if tb.Phase() != "" || !c.Ended {
+		t.Errorf("game should end when too few players are left")
+	}
+}
+
+func TestOtherConn(t *testing.T) {
+	tb, c, say, irc := newTestTable(5)
+	say("alice", "join")
+	say("bob", "join")
+	say("alice", "start")
+
+	// the same names over another connection are other people
+	b := tb.bot
+	web := new(chattest.Conn)
+	b.AddConn(web)
+	web.Sent = nil
+	tb.Event(b, &chat.Message{Conn: web, From: "alice", Room: "#games", Text: "magicalbot: next"})
+	tb.Event(b, &chat.Message{Conn: web, Kind: chat.KindPart, From: "bob", Room: "#games"})
+	if c.Count != 5 || !tb.Playing("bob") || len(web.Sent) != 0 {
+		t.Errorf("count = %d, bob playing = %v, web sent %q", c.Count, tb.Playing("bob"), web.Sent)
+	}
+
+	// private messages go back where the player joined from
+	irc.Sent = nil
+	tb.Tell("alice", "psst")
+	tb.Notice("alice", "your hand")
+	tb.Announce("hello")
+	if len(web.Sent) != 0 || len(irc.Sent) != 3 {
+		t.Errorf("irc sent %q, web sent %q", irc.Sent, web.Sent)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	tb, c, say, conn := newTestTable(3)
+	say("alice", "join")
+	say("bob", "join")
+	say("alice", "start")
+	if tb.Remaining() <= 0 {
+		t.Errorf("phase has no time limit")
+	}
+
+	say("alice", "pause")
+	if !tb.Paused() || tb.Remaining() <= 0 {
+		t.Errorf("pausing lost the time remaining")
+	}
+	say("alice", "next")
+	if c.Count != 3 || !conn.Said("alice", "paused") {
+		t.Errorf("alice moved while the game was paused: %q", conn.Sent)
+	}
+	say("alice", "resume")
+
+	tb.Expire()
+	if !conn.Said("#games", "alice took too long") || c.Turn != "bob" {
+		t.Errorf("timeout didn't move to the next turn: %q", conn.Sent)
+	}
+	say("bob", "next")
+	say("alice", "next")
+	if tb.Phase() != "" || !conn.Said("#games", "alice wins") {
+		t.Errorf("game didn't finish: %q", conn.Sent)
+	}
+	if tb.Remaining() != 0 {
+		t.Errorf("the clock is still running after the game ended")
+	}
+}
+
+func TestSaveRestore(t *testing.T) {
+	store := FileStore(filepath.Join(t.TempDir(), "game.json"))
+	tb, c, say, conn := newTestTable(5)
+	tb.Store = store
+	say("alice", "join")
+	say("bob", "join")
+	say("alice", "start")
+	say("alice", "next")
+	say("alice", "pause")
+
+	c2 := new(countdown)
+	tb2 := &Table{Rules: c2, Store: store}
+	if err := tb2.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if c2.Count != 4 || c2.Turn != "bob" {
+		t.Errorf("restored rules = %+v, want %+v", c2, c)
+	}
+	if tb2.Phase() != "count" || !tb2.Paused() || tb2.Mod() != "alice" || len(tb2.Players()) != 2 {
+		t.Errorf("restored table: phase = %q, paused = %v, mod = %q, players = %v",
+			tb2.Phase(), tb2.Paused(), tb2.Mod(), tb2.Players())
+	}
+	if tb2.Remaining() <= 0 {
+		t.Errorf("the time remaining wasn't saved")
+	}
+
+	// the game is announced the next time anything happens in the room
+	b, _ := chat.NewBot()
+	b.AddConn(conn)
+	conn.Sent = nil
+	tb2.Event(b, &chat.Message{Conn: conn, Kind: chat.KindJoin, From: "magicalbot", Room: "#games"})
+	if !conn.Said("#games", "the game has resumed") || !conn.Said("#games", "paused until alice says resume") {
+		t.Errorf("restored game wasn't announced: %q", conn.Sent)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	tb := &Table{}
+	nick := &chat.Message{From: "Alice"}
+	account := &chat.Message{From: "Alice", Sender: chat.Sender{Nick: "Alice", Account: "AliceW"}}
+	if id := tb.Identity(nick); id != "alice" {
+		t.Errorf("identity without an account = %q", id)
+	}
+	if id := tb.Identity(account); id != "account:alicew" {
+		t.Errorf("identity with an account = %q", id)
+	}
+}
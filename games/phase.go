@@ -0,0 +1,90 @@
+package games
+
+import "time"
+
+// Phase returns the current phase of the game,
+// or "" if no game is in progress.
+func (t *Table) Phase() string { return t.phase }
+
+// SetPhase moves the game into a new phase.
+// If timeout is positive, the rules' Timeout method is called
+// when it runs out, unless the phase changes first.
+// The clock stops while the game is paused.
+func (t *Table) SetPhase(phase string, timeout time.Duration) {
+	t.stopTimer()
+	t.phase = phase
+	t.remaining = 0
+	if timeout <= 0 {
+		return
+	}
+	if t.paused {
+		t.remaining = timeout
+		return
+	}
+	t.startTimer(timeout)
+}
+
+// Remaining returns how much time is left in the current phase,
+// or zero if it has no time limit.
+func (t *Table) Remaining() time.Duration {
+	if t.deadline.IsZero() {
+		return t.remaining
+	}
+	if d := t.deadline.Sub(time.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// Expire ends the current phase as though its time had run out.
+// It must not be called from Rules methods, which can simply
+// call their own Timeout method instead.
+func (t *Table) Expire() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+}
+
+func (t *Table) expire() {
+	t.stopTimer()
+	t.Rules.Timeout(t, t.phase)
+	t.save()
+}
+
+func (t *Table) startTimer(d time.Duration) {
+	t.stopTimer()
+	t.deadline = time.Now().Add(d)
+	gen := t.timerGen
+	t.timer = time.AfterFunc(d, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		// the phase may have changed while we were waiting for the lock
+		if gen != t.timerGen || t.paused {
+			return
+		}
+		t.expire()
+	})
+}
+
+func (t *Table) stopTimer() {
+	t.timerGen++
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.deadline = time.Time{}
+}
+
+func (t *Table) pause() {
+	t.remaining = t.Remaining()
+	t.stopTimer()
+	t.paused = true
+}
+
+func (t *Table) unpause() {
+	t.paused = false
+	if t.remaining > 0 {
+		t.startTimer(t.remaining)
+		t.remaining = 0
+	}
+}
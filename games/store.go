@@ -0,0 +1,134 @@
+package games
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/internal/atomicfile"
+)
+
+// A Store saves game state so that a game can survive a restart.
+type Store interface {
+	// Load returns the most recently saved state,
+	// or nil if nothing has been saved.
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// FileStore is a Store which keeps game state in a file.
+type FileStore string
+
+func (f FileStore) Load() ([]byte, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Save replaces the saved state with data.
+func (f FileStore) Save(data []byte) error {
+	return atomicfile.WriteFile(string(f), data)
+}
+
+// savedTable is the serialized form of a Table.
+type savedTable struct {
+	ID        string
+	Seed      int64 `json:",omitempty"`
+	Room      chat.Room
+	Conn      string `json:",omitempty"`
+	Mod       chat.Person
+	Players   []chat.Person
+	Waiting   []chat.Person
+	IDs       map[chat.Person]string
+	Phase     string
+	Paused    bool          `json:",omitempty"`
+	Remaining time.Duration `json:",omitempty"`
+	Rules     json.RawMessage
+}
+
+// save writes the game state to the store, if there is one.
+// Errors are logged rather than returned; a failed save
+// shouldn't interrupt the game.
+func (t *Table) save() {
+	if t.Store == nil {
+		return
+	}
+	s := &savedTable{
+		ID:        t.id,
+		Seed:      t.seed,
+		Room:      t.room,
+		Conn:      t.connName,
+		Mod:       t.mod,
+		Players:   t.players,
+		Waiting:   t.waiting,
+		IDs:       t.ids,
+		Phase:     t.phase,
+		Paused:    t.paused,
+		Remaining: t.Remaining(),
+	}
+	rules, err := json.Marshal(t.Rules)
+	if err == nil {
+		s.Rules = rules
+		var data []byte
+		data, err = json.Marshal(s)
+		if err == nil {
+			err = t.Store.Save(data)
+		}
+	}
+	if err != nil {
+		log.Printf("games: error saving game: %v", err)
+	}
+}
+
+// Restore loads the saved game state from t.Store.
+// If a game was in progress, it is resumed
+// and the room is told so the next time anything happens there,
+// such as the bot rejoining it.
+func (t *Table) Restore() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Store == nil {
+		return nil
+	}
+	data, err := t.Store.Load()
+	if err != nil || data == nil {
+		return err
+	}
+	var s savedTable
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	// The state of the old random number generator is lost,
+	// so carry on with a fresh seed.
+	t.seedRand()
+	if s.Phase != "" {
+		if t.Source == nil {
+			log.Printf("games: game %q: restored with seed %d (was %d)", s.ID, t.seed, s.Seed)
+		} else {
+			log.Printf("games: game %q: restored using the table's own Source", s.ID)
+		}
+	}
+	if len(s.Rules) > 0 {
+		if err := json.Unmarshal(s.Rules, t.Rules); err != nil {
+			return err
+		}
+	}
+	t.stopTimer()
+	t.id = s.ID
+	t.room = s.Room
+	t.conn, t.connName = nil, s.Conn
+	t.mod = s.Mod
+	t.players = s.Players
+	t.waiting = s.Waiting
+	t.ids = s.IDs
+	t.phase = s.Phase
+	t.paused = s.Paused
+	t.remaining = s.Remaining
+	t.resumed = t.phase != ""
+	return nil
+}
@@ -0,0 +1,31 @@
+// Package atomicfile writes files that are never left half-written.
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile writes data to a temporary file and renames it over filename,
+// so a crash in the middle of a write never leaves a partial file behind.
+func WriteFile(filename string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+// Package chattest has helpers for testing chat handlers.
+package chattest
+
+import (
+	"strings"
+
+	"github.com/magical/chat"
+)
+
+// A Conn is a chat.Conn which records everything sent over it.
+// Each line starts with who it was sent to.
+type Conn struct {
+	Sent []string
+}
+
+func (c *Conn) Send(to chat.Person, message string) error {
+	c.Sent = append(c.Sent, string(to)+" "+message)
+	return nil
+}
+
+func (c *Conn) Respond(m *chat.Message, response string) error {
+	c.Sent = append(c.Sent, string(m.From)+" "+response)
+	return nil
+}
+
+// Said reports whether anything containing s has been sent to room,
+// or to the person by that name.
+func (c *Conn) Said(room chat.Room, s string) bool {
+	for _, line := range c.Sent {
+		if strings.HasPrefix(line, string(room)+" ") && strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Last returns the last line sent, or "" if nothing has been.
+func (c *Conn) Last() string {
+	if len(c.Sent) == 0 {
+		return ""
+	}
+	return c.Sent[len(c.Sent)-1]
+}
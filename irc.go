@@ -19,47 +19,124 @@ type IRCConn struct {
 	sock        net.Conn
 	messageChan chan<- *Message
 	br          *bufio.Reader // owned by readloop
+	offered     []string      // capabilities the server has that we want; owned by readloop
 
-	nick string // our current nickname
+	addr string // where we connected, and how, for diagnostics
 
-	// protects connected
+	ctcpLimit rateLimiter // for automatic replies to CTCP requests
+
+	// protects connected and the fields after it
 	mu sync.Mutex
 	// whether we have completed the welcome sequence
 	// USER/NICK and received a welcome from the server
 	connected bool
+
+	// our current nickname; only readloop changes it,
+	// so readloop may read it without holding mu
+	nick string
+
+	caps     map[string]bool              // capabilities the server has agreed to
+	whox     bool                         // whether the server supports WHOX
+	accounts map[string]string            // lowercased nick -> services account
+	hosts    map[string]string            // lowercased nick -> nick!user@host, as last seen
+	chans    map[string]map[string]bool   // lowercased nick -> lowercased channels we share
+	ops      map[string]bool              // lowercased channels where we have ops
+	bans     map[string]map[string]string // channel -> nick -> the mask we banned them with
+	waiters  []*ircWaiter                 // commands waiting for a reply
 }
 
-const ircDefaultPort = "6697" // RFC 7194
+func init() {
+	dial := func(rawurl string, messageChan chan<- *Message) (Conn, error) {
+		c, err := DialIRC(rawurl, messageChan)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	RegisterScheme("irc", dial)
+	RegisterScheme("ircs", dial)
+}
+
+const ircDefaultPort = "6667"
+const ircsDefaultPort = "6697" // RFC 7194
 const ircMaxLine = 512
 
+// DialIRC connects to an IRC server, in plain text for irc:// URLs
+// and over TLS for ircs:// URLs. The TLS settings can be changed
+// with the query parameters described at tlsOptions, and the proxy
+// parameter names a proxy to connect through; see ProxyDialer.
 func DialIRC(server string, messageChan chan<- *Message) (*IRCConn, error) {
 	u, err := url.Parse(server)
 	if err != nil {
 		return nil, err
 	}
-	if u.Scheme != "ircs" {
-		return nil, errors.New("DialIRC: scheme must be ircs://")
+	port := ircDefaultPort
+	switch u.Scheme {
+	case "irc":
+		if hasTLSOptions(u.Query()) {
+			return nil, errors.New("DialIRC: TLS options need an ircs:// URL")
+		}
+	case "ircs":
+		port = ircsDefaultPort
+	default:
+		return nil, errors.New("DialIRC: scheme must be irc:// or ircs://")
 	}
 	host := u.Host
 	if _, _, err := net.SplitHostPort(host); err != nil {
-		host = net.JoinHostPort(host, ircDefaultPort)
+		host = net.JoinHostPort(host, port)
 	}
-	sock, err := tls.Dial("tcp", host, nil)
+	dialer, err := dialerFor(u.Query())
 	if err != nil {
 		return nil, err
 	}
+	sock, err := dialer.Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	desc := "plain text"
+	if u.Scheme == "ircs" {
+		opts, err := parseTLSOptions(u.Query())
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+		conf, err := opts.config(u.Hostname())
+		if err != nil {
+			sock.Close()
+			return nil, err
+		}
+		desc = opts.String()
+		tlsConn := tls.Client(sock, conf)
+		if err := tlsConn.Handshake(); err != nil {
+			sock.Close()
+			return nil, err
+		}
+		sock = tlsConn
+	}
+	if proxy, ok := dialer.(fmt.Stringer); ok {
+		desc += ", via " + proxy.String()
+	}
 	c := &IRCConn{
 		sock:        sock,
 		br:          bufio.NewReaderSize(sock, ircMaxLine),
 		nick:        "magicalbot",
+		addr:        host + " (" + desc + ")",
 		messageChan: messageChan,
 		connected:   false,
+		ctcpLimit:   rateLimiter{burst: 3, every: 2 * time.Second},
 	}
+	log.Printf("irc: connected to %s", c.addr)
 	go c.connect()
 	return c, nil
 }
 
+// String describes the connection, for diagnostics.
+func (c *IRCConn) String() string {
+	return "irc " + c.addr
+}
+
 func (c *IRCConn) connect() {
+	fmt.Fprint(c.sock, "CAP LS 302\r\n")
 	fmt.Fprint(c.sock, "USER bot . . :IRC Bot\r\n")
 	fmt.Fprint(c.sock, "NICK magicalbot\r\n")
 	// XXX wait for 001 RPL_WELCOME
@@ -89,19 +166,44 @@ func (c *IRCConn) readloop() {
 		log.Printf("%q", line)
 		// :subject action object rest
 		// BUG doesn't handle multiple spaces
+		tags, line := parseTags(line)
 		subject, command, params, err := splitline(line)
 		if err != nil {
 			log.Printf("IRCConn.loop: malformed line: %q", line)
 			continue
 		}
+		c.seen(subject)
+		if nick := striphost(subject); nick != subject && c.hasCap("account-tag") {
+			// no tag means they aren't logged in
+			c.setAccount(nick, tags["account"])
+		}
+		c.checkWaiters(subject, command, params)
 		switch command {
 		case "PING":
 			if len(params) == 1 {
 				c.write("PONG", params[0]) // XXX
 				log.Println("ponging")
 			}
-		case "PRIVMSG":
-			c.handlePrivmsg(subject, params)
+		case "PRIVMSG", "NOTICE":
+			c.handlePrivmsg(subject, command, params)
+		case "JOIN", "PART", "QUIT", "KICK":
+			c.handleMembership(subject, command, params)
+		case "MODE":
+			c.handleMode(params)
+		case "353": // RPL_NAMREPLY
+			c.handleNames(params)
+		case "CAP":
+			c.handleCap(params)
+		case "NICK":
+			c.handleNick(subject, params)
+		case "ACCOUNT":
+			if len(params) > 0 {
+				c.setAccount(striphost(subject), params[0])
+			}
+		case "005": // RPL_ISUPPORT
+			c.handleISupport(params)
+		case "354": // RPL_WHOSPCRPL
+			c.handleWhox(params)
 		}
 	}
 }
@@ -168,10 +270,15 @@ func (c *IRCConn) write(command, param string) {
 	}
 }
 
-func (c *IRCConn) handlePrivmsg(user string, params []string) {
+func (c *IRCConn) handlePrivmsg(user, command string, params []string) {
 	// :user PRIVMSG channel :msg
+	// :user NOTICE channel :msg
 	if len(params) != 2 {
-		log.Printf("IRCConn.handlePrivmsg: malformed PRIVMSG %q", params)
+		log.Printf("IRCConn.handlePrivmsg: malformed %s %q", command, params)
+		return
+	}
+	if command == "NOTICE" && !strings.Contains(user, "!") {
+		// from the server, not a person
 		return
 	}
 	if striphost(user) == c.nick {
@@ -183,30 +290,153 @@ func (c *IRCConn) handlePrivmsg(user string, params []string) {
 	var m Message
 	m.Conn = c
 	m.From = Person(striphost(user))
+	m.Sender = c.sender(user)
 	if channel != c.nick {
 		m.Room = Room(channel) // TODO: multiple receivers?
 	}
 	m.RawText = text
 	m.Text = text // TODO strip receiver from mesg
+	if command == "NOTICE" {
+		m.Kind = KindNotice
+	}
+	if ctcp, args, ok := splitCTCP(text); ok {
+		if ctcp != "ACTION" {
+			if command == "PRIVMSG" {
+				c.replyCTCP(m.From, ctcp, args)
+			}
+			// and a notice is someone's reply, which we never asked for
+			return
+		}
+		m.Kind = KindAction
+		m.Text = args
+	}
+	if hasFormatting(m.Text) {
+		m.Spans = ParseFormatting(m.Text)
+		m.Text = StripFormatting(m.Text)
+	}
+	c.messageChan <- &m
+}
+
+// replyCTCP answers a CTCP request with a NOTICE,
+// unless we have been answering too many of them.
+func (c *IRCConn) replyCTCP(to Person, command, args string) {
+	reply, ok := ctcpReply(command, args, time.Now())
+	if !ok {
+		log.Printf("irc: ignoring CTCP %s from %s", command, to)
+		return
+	}
+	if !c.ctcpLimit.allow(time.Now()) {
+		log.Printf("irc: not answering CTCP %s from %s: too many requests", command, to)
+		return
+	}
+	if reply != "" {
+		reply = " " + reply
+	}
+	fmt.Fprintf(c.sock, "NOTICE %s :\x01%s%s\x01\r\n", to, command, reply)
+}
+
+func (c *IRCConn) handleMembership(user, command string, params []string) {
+	// :user JOIN channel
+	// :user JOIN channel account :realname (with extended-join)
+	// :user PART channel [:reason]
+	// :user QUIT [:reason]
+	// :user KICK channel victim [:reason]
+	var m Message
+	m.Conn = c
+	m.From = Person(striphost(user))
+	switch command {
+	case "JOIN", "PART":
+		if len(params) < 1 {
+			log.Printf("IRCConn.handleMembership: malformed %s %q", command, params)
+			return
+		}
+		m.Kind = KindJoin
+		if command == "PART" {
+			m.Kind = KindPart
+		}
+		m.Room = Room(params[0])
+		if command == "JOIN" && len(params) > 2 && c.hasCap("extended-join") {
+			c.setAccount(string(m.From), params[1])
+		} else if command == "PART" && len(params) > 1 {
+			m.RawText = params[1]
+		}
+	case "QUIT":
+		m.Kind = KindQuit
+		if len(params) > 0 {
+			m.RawText = params[0]
+		}
+	case "KICK":
+		if len(params) < 2 {
+			log.Printf("IRCConn.handleMembership: malformed KICK %q", params)
+			return
+		}
+		m.Kind = KindPart
+		m.Room = Room(params[0])
+		m.From = Person(params[1])
+		if len(params) > 2 {
+			m.RawText = params[2]
+		}
+	}
+	m.Sender = c.sender(c.hostmask(string(m.From)))
+	switch m.Kind {
+	case KindJoin:
+		c.joined(string(m.From), string(m.Room))
+		if string(m.From) == c.nick {
+			c.whoRoom(string(m.Room))
+		}
+	case KindPart:
+		c.parted(string(m.From), string(m.Room))
+		if string(m.From) == c.nick {
+			c.setOp(string(m.Room), false)
+		}
+	case KindQuit:
+		c.mu.Lock()
+		c.forget(strings.ToLower(string(m.From)))
+		c.mu.Unlock()
+	}
 	c.messageChan <- &m
 }
 
 func (c *IRCConn) Send(to Person, message string) error {
-	fmt.Fprintf(c.sock, "PRIVMSG %s :%s\r\n", to, message)
-	return nil
+	if err := checkParams(message, string(to)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(c.sock, "PRIVMSG %s :%s\r\n", to, message)
+	return err
+}
+
+// Notice sends a NOTICE, which clients must not reply to automatically.
+func (c *IRCConn) Notice(to Person, message string) error {
+	if err := checkParams(message, string(to)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(c.sock, "NOTICE %s :%s\r\n", to, message)
+	return err
+}
+
+// Action sends a CTCP ACTION to a room, like /me.
+func (c *IRCConn) Action(room Room, text string) error {
+	if err := checkParams(text, string(room)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(c.sock, "PRIVMSG %s :\x01ACTION %s\x01\r\n", room, text)
+	return err
 }
 
 func (c *IRCConn) Respond(m *Message, response string) error {
 	if m.Room != "" {
 		to := m.From
-		if string(m.Room) == c.nick {
+		if string(m.Room) == c.ourNick() {
 			log.Printf("error: tried to send message to self: %q", response)
 			return errors.New("invalid receiver")
 		}
-		fmt.Fprintf(c.sock, "PRIVMSG %s :%s: %s\r\n", m.Room, to, response)
-		return nil
+		if err := checkParams(response, string(m.Room), string(to)); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(c.sock, "PRIVMSG %s :%s: %s\r\n", m.Room, to, response)
+		return err
 	} else {
-		if string(m.From) == c.nick {
+		if string(m.From) == c.ourNick() {
 			log.Printf("error: tried to send message to self: %q", response)
 			return errors.New("invalid receiver")
 		}
@@ -223,3 +453,9 @@ func striphost(s string) string {
 }
 
 func (c *IRCConn) writeloop() {}
+
+// Close says goodbye and disconnects.
+func (c *IRCConn) Close() error {
+	fmt.Fprint(c.sock, "QUIT\r\n")
+	return c.sock.Close()
+}
@@ -0,0 +1,204 @@
+package chat
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ircWantCaps are the IRCv3 capabilities we ask for, if the server has them,
+// so that we know which services account people are logged in to.
+var ircWantCaps = []string{"account-tag", "account-notify", "extended-join"}
+
+// parseTags splits the IRCv3 message tags, @key=value;key, off the front of a line.
+func parseTags(line []byte) (map[string]string, []byte) {
+	if len(line) == 0 || line[0] != '@' {
+		return nil, line
+	}
+	i := bytes.IndexByte(line, ' ')
+	if i < 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(string(line[1:i]), ";") {
+		if tag == "" {
+			continue
+		}
+		key, value := tag, ""
+		if j := strings.IndexByte(tag, '='); j >= 0 {
+			key, value = tag[:j], unescapeTag(tag[j+1:])
+		}
+		tags[key] = value
+	}
+	return tags, line[i+1:]
+}
+
+var tagUnescaper = strings.NewReplacer(`\:`, ";", `\s`, " ", `\\`, `\`, `\r`, "\r", `\n`, "\n")
+
+func unescapeTag(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return tagUnescaper.Replace(s)
+}
+
+// handleCap negotiates capabilities: we ask for the ones we want
+// from those the server lists, and end negotiation once it answers.
+func (c *IRCConn) handleCap(params []string) {
+	// :server CAP * LS [*] :cap cap=value ...
+	// :server CAP nick ACK :cap cap
+	// :server CAP nick NAK :cap cap
+	if len(params) < 3 {
+		return
+	}
+	switch params[1] {
+	case "LS":
+		for _, cap := range strings.Fields(params[len(params)-1]) {
+			if i := strings.IndexByte(cap, '='); i >= 0 {
+				cap = cap[:i]
+			}
+			for _, want := range ircWantCaps {
+				if cap == want {
+					c.offered = append(c.offered, cap)
+				}
+			}
+		}
+		if len(params) > 3 && params[2] == "*" {
+			// more to come
+			return
+		}
+		if len(c.offered) == 0 {
+			fmt.Fprint(c.sock, "CAP END\r\n")
+			return
+		}
+		fmt.Fprintf(c.sock, "CAP REQ :%s\r\n", strings.Join(c.offered, " "))
+	case "ACK":
+		c.mu.Lock()
+		if c.caps == nil {
+			c.caps = make(map[string]bool)
+		}
+		for _, cap := range strings.Fields(params[2]) {
+			c.caps[cap] = true
+		}
+		c.mu.Unlock()
+		fmt.Fprint(c.sock, "CAP END\r\n")
+	case "NAK":
+		fmt.Fprint(c.sock, "CAP END\r\n")
+	}
+}
+
+func (c *IRCConn) hasCap(cap string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps[cap]
+}
+
+// handleISupport notes whether the server supports WHOX.
+func (c *IRCConn) handleISupport(params []string) {
+	// :server 005 nick TOKEN TOKEN=value ... :are supported by this server
+	for _, token := range params {
+		if token == "WHOX" {
+			c.mu.Lock()
+			c.whox = true
+			c.mu.Unlock()
+		}
+	}
+}
+
+// whoRoom asks the server for the accounts of everyone in room,
+// if it can tell us.
+func (c *IRCConn) whoRoom(room string) {
+	c.mu.Lock()
+	whox := c.whox
+	c.mu.Unlock()
+	if whox {
+		// token, user, host, nick, account
+		fmt.Fprintf(c.sock, "WHO %s %%tuhna,%s\r\n", room, ircWhoToken)
+	}
+}
+
+// ircWhoToken marks the WHOX replies to our own requests.
+const ircWhoToken = "42"
+
+// handleWhox records a user's host and account from a WHOX reply.
+func (c *IRCConn) handleWhox(params []string) {
+	// :server 354 ournick 42 user host nick account
+	if len(params) < 6 || params[1] != ircWhoToken {
+		return
+	}
+	user, host, nick, account := params[2], params[3], params[4], params[5]
+	c.seen(nick + "!" + user + "@" + host)
+	if account == "0" {
+		account = ""
+	}
+	c.setAccount(nick, account)
+}
+
+// setAccount records the account nick is logged in to; "" or "*" means none.
+func (c *IRCConn) setAccount(nick, account string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accounts == nil {
+		c.accounts = make(map[string]string)
+	}
+	if account == "" || account == "*" {
+		delete(c.accounts, strings.ToLower(nick))
+	} else {
+		c.accounts[strings.ToLower(nick)] = account
+	}
+}
+
+// handleNick moves what we know about someone to their new nick,
+// so that whoever takes the old one doesn't inherit it.
+func (c *IRCConn) handleNick(subject string, params []string) {
+	// :old!user@host NICK new
+	old := striphost(subject)
+	if len(params) < 1 || old == subject {
+		return
+	}
+	nick := params[0]
+	oldKey, key := strings.ToLower(old), strings.ToLower(nick)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if strings.EqualFold(old, c.nick) {
+		c.nick = nick
+	}
+	if account, ok := c.accounts[oldKey]; ok {
+		delete(c.accounts, oldKey)
+		c.accounts[key] = account
+	} else {
+		delete(c.accounts, key)
+	}
+	if chans, ok := c.chans[oldKey]; ok {
+		delete(c.chans, oldKey)
+		c.chans[key] = chans
+	}
+	delete(c.hosts, oldKey)
+	if c.hosts == nil {
+		c.hosts = make(map[string]string)
+	}
+	c.hosts[key] = nick + subject[len(old):]
+}
+
+// ourNick returns our current nickname.
+func (c *IRCConn) ourNick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// sender describes whoever sent a line with the prefix nick!user@host.
+func (c *IRCConn) sender(prefix string) Sender {
+	var s Sender
+	s.Nick = prefix
+	if i := strings.IndexByte(prefix, '!'); i >= 0 {
+		s.Nick, s.User = prefix[:i], prefix[i+1:]
+		if j := strings.IndexByte(s.User, '@'); j >= 0 {
+			s.User, s.Host = s.User[:j], s.User[j+1:]
+		}
+	}
+	c.mu.Lock()
+	s.Account = c.accounts[strings.ToLower(s.Nick)]
+	c.mu.Unlock()
+	return s
+}
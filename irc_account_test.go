@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	tests := []struct {
+		line string
+		tags map[string]string
+		rest string
+	}{
+		{":a PRIVMSG #b :c", nil, ":a PRIVMSG #b :c"},
+		{"@account=alice :a PRIVMSG #b :c", map[string]string{"account": "alice"}, ":a PRIVMSG #b :c"},
+		{`@a=1;b;c=x\sy\:z\\ PING`, map[string]string{"a": "1", "b": "", "c": `x y;z\`}, "PING"},
+	}
+	for _, tt := range tests {
+		tags, rest := parseTags([]byte(tt.line))
+		if !reflect.DeepEqual(tags, tt.tags) || string(rest) != tt.rest {
+			t.Errorf("parseTags(%q) = %v, %q; want %v, %q", tt.line, tags, rest, tt.tags, tt.rest)
+		}
+	}
+}
+
+func TestIRCAccounts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	messages := make(chan *Message, 10)
+	c, err := DialIRC("irc://"+l.Addr().String()+"/magical", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "USER ") || strings.HasPrefix(line, "NICK ") {
+				continue
+			}
+			if line != want {
+				t.Errorf("server got %q, want %q", line, want)
+			}
+			return
+		}
+	}
+
+	expect("CAP LS 302")
+	fmt.Fprint(conn, ":irc.example.net CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL account-tag\r\n")
+	fmt.Fprint(conn, ":irc.example.net CAP * LS :account-notify extended-join\r\n")
+	expect("CAP REQ :account-tag account-notify extended-join")
+	fmt.Fprint(conn, ":irc.example.net CAP magicalbot ACK :account-tag account-notify extended-join\r\n")
+	expect("CAP END")
+	fmt.Fprint(conn, ":irc.example.net 005 magicalbot WHOX CHANTYPES=# :are supported by this server\r\n")
+
+	// joining a room asks who is in it
+	fmt.Fprint(conn, ":magicalbot!bot@example.org JOIN #magical * :IRC Bot\r\n")
+	receive(t, messages)
+	expect("WHO #magical %tuhna,42")
+	fmt.Fprint(conn, ":irc.example.net 354 magicalbot 42 bob bob.example.com bob bobw\r\n")
+	fmt.Fprint(conn, ":irc.example.net 354 magicalbot 42 carol carol.example.com carol 0\r\n")
+	// the account follows a nick change, and doesn't stay with the old nick
+	fmt.Fprint(conn, "@account=bobw :bob!bob@bob.example.com NICK bob_\r\n")
+	fmt.Fprint(conn, ":magicalbot!bot@example.org KICK #magical bob_ :out\r\n")
+	m := receive(t, messages)
+	if want := (Sender{Nick: "bob_", User: "bob", Host: "bob.example.com", Account: "bobw"}); m.Sender != want {
+		t.Errorf("kicked sender = %+v, want %+v", m.Sender, want)
+	}
+	fmt.Fprint(conn, ":magicalbot!bot@example.org KICK #magical bob :out\r\n")
+	if m = receive(t, messages); m.Sender != (Sender{Nick: "bob"}) {
+		t.Errorf("sender after nick change = %+v, want nothing known", m.Sender)
+	}
+
+	// and so does our own nick
+	fmt.Fprint(conn, ":magicalbot!bot@example.org NICK magicbot\r\n")
+	fmt.Fprint(conn, ":carol!carol@carol.example.com PRIVMSG magicbot :psst\r\n")
+	if m = receive(t, messages); m.Room != "" {
+		t.Errorf("private message to our new nick went to room %q", m.Room)
+	}
+
+	fmt.Fprint(conn, "@account=AliceW;time=2026-01-01T00:00:00Z :alice!al@alice.example.com PRIVMSG #magical :hi\r\n")
+	m = receive(t, messages)
+	if want := (Sender{Nick: "alice", User: "al", Host: "alice.example.com", Account: "AliceW"}); m.Sender != want {
+		t.Errorf("sender = %+v, want %+v", m.Sender, want)
+	}
+	// without the tag, they've logged out
+	fmt.Fprint(conn, ":alice!al@alice.example.com PRIVMSG #magical :bye\r\n")
+	if m = receive(t, messages); m.Sender.Account != "" {
+		t.Errorf("account = %q after logging out", m.Sender.Account)
+	}
+
+	fmt.Fprint(conn, "@account=dave :dave!d@dave.example.com JOIN #magical dave :Dave\r\n")
+	if m = receive(t, messages); m.Kind != KindJoin || m.Sender.Account != "dave" || m.RawText != "" {
+		t.Errorf("extended join = %+v", m)
+	}
+}
@@ -0,0 +1,418 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ircReplyTimeout is how long a moderation command waits for the server
+// to confirm it. Servers say nothing when a mode is already set,
+// so running out of time is taken as success for MODE,
+// and as an error for anything else.
+var ircReplyTimeout = 10 * time.Second
+
+// errNoReply is returned when the server doesn't answer a command.
+var errNoReply = errors.New("irc: no reply from the server")
+
+// An IRCError is an error reply from an IRC server.
+type IRCError struct {
+	Code   string   // the numeric, such as "482" for ERR_CHANOPRIVSNEEDED
+	Params []string // everything after the code, starting with our nick
+}
+
+func (e *IRCError) Error() string {
+	var text, about string
+	if n := len(e.Params); n > 0 {
+		text = e.Params[n-1]
+		if n > 2 {
+			about = strings.Join(e.Params[1:n-1], " ") + ": "
+		}
+	}
+	return "irc: " + e.Code + " " + about + text
+}
+
+// isErrorReply reports whether command is an error numeric.
+func isErrorReply(command string) bool {
+	return len(command) == 3 && (command[0] == '4' || command[0] == '5') &&
+		'0' <= command[1] && command[1] <= '9' && '0' <= command[2] && command[2] <= '9'
+}
+
+// An ircWaiter waits for the reply to a command.
+type ircWaiter struct {
+	// ok matches a line which means the command worked
+	ok func(subject, command string, params []string) bool
+	// an error reply with one of these numerics
+	// about any of these is for this command
+	errs  []string
+	about []string
+	// whether the server may not reply at all when the command works
+	quiet bool
+	done  chan error
+}
+
+// The error numerics each command can get.
+var (
+	ircKickErrors   = []string{"401", "403", "441", "442", "482"}
+	ircModeErrors   = []string{"401", "403", "442", "472", "478", "482"}
+	ircTopicErrors  = []string{"403", "442", "482"}
+	ircInviteErrors = []string{"401", "403", "442", "443", "482"}
+)
+
+// checkWaiters hands a line to the first command waiting for it.
+func (c *IRCConn) checkWaiters(subject, command string, params []string) {
+	isErr := isErrorReply(command)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		var err error
+		switch {
+		case isErr && w.canFail(command) && w.mentioned(params):
+			err = &IRCError{Code: command, Params: params}
+		case !isErr && w.ok(subject, command, params):
+		default:
+			continue
+		}
+		w.done <- err
+		c.waiters = append(c.waiters[:i:i], c.waiters[i+1:]...)
+		return
+	}
+}
+
+func (w *ircWaiter) canFail(code string) bool {
+	for _, e := range w.errs {
+		if e == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *ircWaiter) mentioned(params []string) bool {
+	if len(params) < 2 {
+		return false
+	}
+	for _, p := range params[1 : len(params)-1] {
+		for _, a := range w.about {
+			if strings.EqualFold(p, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// command sends a command and waits for the server to accept or refuse it.
+func (c *IRCConn) command(w *ircWaiter, format string, args ...interface{}) error {
+	w.done = make(chan error, 1)
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		for i, x := range c.waiters {
+			if x == w {
+				c.waiters = append(c.waiters[:i:i], c.waiters[i+1:]...)
+				break
+			}
+		}
+		c.mu.Unlock()
+	}()
+	if _, err := fmt.Fprintf(c.sock, format+"\r\n", args...); err != nil {
+		return err
+	}
+	select {
+	case err := <-w.done:
+		return err
+	case <-time.After(ircReplyTimeout):
+		if w.quiet {
+			return nil
+		}
+		return errNoReply
+	}
+}
+
+// fromUs returns a matcher for our own command echoed back by the server
+// for the given channel.
+func (c *IRCConn) fromUs(command string, room Room) func(string, string, []string) bool {
+	return func(subject, cmd string, params []string) bool {
+		return cmd == command && strings.EqualFold(striphost(subject), c.nick) &&
+			len(params) > 0 && strings.EqualFold(params[0], string(room))
+	}
+}
+
+// checkParams returns an error if a command's parameters would break
+// the line it is sent on: none may contain CR, LF or NUL, which could
+// end it and start another command, and the ones before the trailing
+// parameter must be single words.
+func checkParams(trailing string, middle ...string) error {
+	for _, p := range middle {
+		if p == "" || p[0] == ':' || strings.ContainsAny(p, " \r\n\x00") {
+			return fmt.Errorf("irc: invalid parameter %q", p)
+		}
+	}
+	if strings.ContainsAny(trailing, "\r\n\x00") {
+		return fmt.Errorf("irc: invalid parameter %q", trailing)
+	}
+	return nil
+}
+
+// seen remembers the hostmask of whoever sent a line,
+// until they leave the rooms we share with them; see parted.
+func (c *IRCConn) seen(subject string) {
+	nick := striphost(subject)
+	if nick == subject {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.hosts == nil {
+		c.hosts = make(map[string]string)
+	}
+	c.hosts[strings.ToLower(nick)] = subject
+}
+
+// hostmask returns nick!user@host for nick as we last saw it,
+// or just nick if we haven't.
+func (c *IRCConn) hostmask(nick string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hostmask, ok := c.hosts[strings.ToLower(nick)]; ok {
+		return hostmask
+	}
+	return nick
+}
+
+// joined notes that nick is in room.
+func (c *IRCConn) joined(nick, room string) {
+	key := strings.ToLower(nick)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chans == nil {
+		c.chans = make(map[string]map[string]bool)
+	}
+	if c.chans[key] == nil {
+		c.chans[key] = make(map[string]bool)
+	}
+	c.chans[key][strings.ToLower(room)] = true
+}
+
+// parted notes that nick has left room, and forgets them
+// once they aren't in any room with us. When we leave a room,
+// we lose track of everyone in it.
+func (c *IRCConn) parted(nick, room string) {
+	room = strings.ToLower(room)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	leaving := []string{strings.ToLower(nick)}
+	if strings.EqualFold(nick, c.nick) {
+		leaving = leaving[:0]
+		for key := range c.chans {
+			leaving = append(leaving, key)
+		}
+	}
+	for _, key := range leaving {
+		delete(c.chans[key], room)
+		if len(c.chans[key]) == 0 {
+			c.forget(key)
+		}
+	}
+}
+
+// forget forgets the host and account of the lowercased nick.
+// The caller must hold c.mu.
+func (c *IRCConn) forget(key string) {
+	delete(c.hosts, key)
+	delete(c.accounts, key)
+	delete(c.chans, key)
+}
+
+// banMask returns a mask which bans p by their host,
+// or by nick if we haven't seen their host.
+func (c *IRCConn) banMask(p Person) string {
+	hostmask := c.hostmask(string(p))
+	if i := strings.LastIndexByte(hostmask, '@'); i >= 0 {
+		return "*!*" + hostmask[i:]
+	}
+	return string(p) + "!*@*"
+}
+
+func (c *IRCConn) setOp(room string, op bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ops == nil {
+		c.ops = make(map[string]bool)
+	}
+	if op {
+		c.ops[strings.ToLower(room)] = true
+	} else {
+		delete(c.ops, strings.ToLower(room))
+	}
+}
+
+// IsOp reports whether we are a channel operator in room.
+func (c *IRCConn) IsOp(room Room) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ops[strings.ToLower(string(room))]
+}
+
+// handleNames notes who is in a channel from a NAMES reply,
+// and whether we have ops there.
+func (c *IRCConn) handleNames(params []string) {
+	// :server 353 ournick = #channel :@nick +nick nick
+	if len(params) < 4 {
+		return
+	}
+	for _, name := range strings.Fields(params[3]) {
+		nick := strings.TrimLeft(name, "~&@%+")
+		c.joined(nick, params[2])
+		if strings.EqualFold(nick, c.nick) {
+			c.setOp(params[2], strings.ContainsAny(name[:len(name)-len(nick)], "~&@"))
+		}
+	}
+}
+
+// handleMode notes when we are given or lose ops.
+func (c *IRCConn) handleMode(params []string) {
+	// :user MODE #channel +ov-b nick nick mask
+	if len(params) < 2 || params[0] == "" || !strings.ContainsAny(params[0][:1], "#&+!") {
+		return
+	}
+	args := params[2:]
+	add := true
+	for _, mode := range params[1] {
+		var arg string
+		switch {
+		case mode == '+' || mode == '-':
+			add = mode == '+'
+			continue
+		case strings.ContainsRune("qaohvbeIk", mode) || mode == 'l' && add:
+			if len(args) == 0 {
+				return
+			}
+			arg, args = args[0], args[1:]
+		}
+		if strings.ContainsRune("qao", mode) && strings.EqualFold(arg, c.nick) {
+			c.setOp(params[0], add)
+		}
+	}
+}
+
+// Kick removes p from room.
+func (c *IRCConn) Kick(room Room, p Person, reason string) error {
+	if err := checkParams(reason, string(room), string(p)); err != nil {
+		return err
+	}
+	ok := c.fromUs("KICK", room)
+	return c.command(&ircWaiter{
+		ok: func(subject, command string, params []string) bool {
+			return ok(subject, command, params) && len(params) > 1 && strings.EqualFold(params[1], string(p))
+		},
+		errs:  ircKickErrors,
+		about: []string{string(room), string(p)},
+	}, "KICK %s %s :%s", room, p, reason)
+}
+
+// Ban bans p from room by their host, *!*@host,
+// or by their nick if we haven't seen them.
+func (c *IRCConn) Ban(room Room, p Person) error {
+	if err := checkParams("", string(room), string(p)); err != nil {
+		return err
+	}
+	mask := c.banMask(p)
+	err := c.command(&ircWaiter{
+		ok:    c.fromUs("MODE", room),
+		errs:  ircModeErrors,
+		about: []string{string(room), mask},
+		quiet: true,
+	}, "MODE %s +b %s", room, mask)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bans == nil {
+		c.bans = make(map[string]map[string]string)
+	}
+	key := strings.ToLower(string(room))
+	if c.bans[key] == nil {
+		c.bans[key] = make(map[string]string)
+	}
+	c.bans[key][strings.ToLower(string(p))] = mask
+	return nil
+}
+
+// Unban lifts a ban on p in room: the one we made with Ban, if any,
+// or else the one Ban would make.
+func (c *IRCConn) Unban(room Room, p Person) error {
+	if err := checkParams("", string(room), string(p)); err != nil {
+		return err
+	}
+	key, nick := strings.ToLower(string(room)), strings.ToLower(string(p))
+	c.mu.Lock()
+	mask, ok := c.bans[key][nick]
+	c.mu.Unlock()
+	if !ok {
+		mask = c.banMask(p)
+	}
+	err := c.command(&ircWaiter{
+		ok:    c.fromUs("MODE", room),
+		errs:  ircModeErrors,
+		about: []string{string(room), mask},
+		quiet: true,
+	}, "MODE %s -b %s", room, mask)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	delete(c.bans[key], nick)
+	c.mu.Unlock()
+	return nil
+}
+
+// SetMode changes the modes of a room, such as "+m" or "+o" with a nick.
+func (c *IRCConn) SetMode(room Room, modes string, args ...string) error {
+	if modes == "" {
+		return errors.New("irc: no modes to set")
+	}
+	if err := checkParams("", append([]string{string(room), modes}, args...)...); err != nil {
+		return err
+	}
+	line := strings.Join(append([]string{string(room), modes}, args...), " ")
+	return c.command(&ircWaiter{
+		ok:    c.fromUs("MODE", room),
+		errs:  ircModeErrors,
+		about: []string{string(room)},
+		quiet: true,
+	}, "MODE %s", line)
+}
+
+// SetTopic changes the topic of a room.
+func (c *IRCConn) SetTopic(room Room, topic string) error {
+	if err := checkParams(topic, string(room)); err != nil {
+		return err
+	}
+	return c.command(&ircWaiter{
+		ok:    c.fromUs("TOPIC", room),
+		errs:  ircTopicErrors,
+		about: []string{string(room)},
+	}, "TOPIC %s :%s", room, topic)
+}
+
+// Invite invites p to room.
+func (c *IRCConn) Invite(room Room, p Person) error {
+	if err := checkParams("", string(room), string(p)); err != nil {
+		return err
+	}
+	return c.command(&ircWaiter{
+		ok: func(subject, command string, params []string) bool {
+			// :server 341 ournick nick #channel
+			return command == "341" && len(params) > 2 &&
+				strings.EqualFold(params[1], string(p)) && strings.EqualFold(params[2], string(room))
+		},
+		errs:  ircInviteErrors,
+		about: []string{string(room), string(p)},
+	}, "INVITE %s %s", p, room)
+}
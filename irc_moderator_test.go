@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIRCModerator(t *testing.T) {
+	defer func(d time.Duration) { ircReplyTimeout = d }(ircReplyTimeout)
+	ircReplyTimeout = 100 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	messages := make(chan *Message, 10)
+	c, err := DialIRC("irc://"+l.Addr().String()+"/magical", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var _ Moderator = c
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "CAP ") || strings.HasPrefix(line, "USER ") || strings.HasPrefix(line, "NICK ") {
+				continue
+			}
+			if line != want {
+				t.Errorf("server got %q, want %q", line, want)
+			}
+			return
+		}
+	}
+	// sync waits until the conn has read everything sent so far
+	sync := func() {
+		t.Helper()
+		fmt.Fprint(conn, ":alice!alice@host.example.com PRIVMSG #magical :sync\r\n")
+		receive(t, messages)
+	}
+	run := func(f func() error) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- f() }()
+		return done
+	}
+
+	fmt.Fprint(conn, ":irc.example.net 353 magicalbot = #magical :@magicalbot alice +bob\r\n")
+	sync()
+	if !c.IsOp("#Magical") {
+		t.Error("NAMES reply with @magicalbot didn't give us ops")
+	}
+
+	done := run(func() error { return c.Ban("#magical", "alice") })
+	expect("MODE #magical +b *!*@host.example.com")
+	fmt.Fprint(conn, ":magicalbot!bot@example.org MODE #magical +b *!*@host.example.com\r\n")
+	if err := <-done; err != nil {
+		t.Errorf("Ban: %v", err)
+	}
+
+	done = run(func() error { return c.Kick("#magical", "alice", "bye") })
+	expect("KICK #magical alice :bye")
+	// an error which a kick can't get is for something else
+	fmt.Fprint(conn, ":irc.example.net 404 magicalbot #magical :Cannot send to channel\r\n")
+	fmt.Fprint(conn, ":magicalbot!bot@example.org KICK #magical alice :bye\r\n")
+	if err := <-done; err != nil {
+		t.Errorf("Kick: %v", err)
+	}
+	m := receive(t, messages) // alice's part
+	if m.Sender.Host != "host.example.com" {
+		t.Errorf("kicked sender = %+v", m.Sender)
+	}
+	// she's gone from the only room we shared, so we forget her
+	if mask := c.hostmask("alice"); mask != "alice" {
+		t.Errorf("hostmask after kick = %q", mask)
+	}
+
+	done = run(func() error { return c.Unban("#magical", "alice") })
+	expect("MODE #magical -b *!*@host.example.com")
+	fmt.Fprint(conn, ":irc.example.net 482 magicalbot #magical :You're not channel operator\r\n")
+	err = <-done
+	if ircErr, ok := err.(*IRCError); !ok || ircErr.Code != "482" {
+		t.Errorf("Unban error = %v, want a 482", err)
+	} else if want := "irc: 482 #magical: You're not channel operator"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+
+	done = run(func() error { return c.Invite("#magical", "carol") })
+	expect("INVITE carol #magical")
+	fmt.Fprint(conn, ":irc.example.net 401 magicalbot carol :No such nick/channel\r\n")
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "No such nick") {
+		t.Errorf("Invite error = %v", err)
+	}
+	done = run(func() error { return c.Invite("#magical", "bob") })
+	expect("INVITE bob #magical")
+	fmt.Fprint(conn, ":irc.example.net 341 magicalbot bob #magical\r\n")
+	if err := <-done; err != nil {
+		t.Errorf("Invite: %v", err)
+	}
+
+	done = run(func() error { return c.SetTopic("#magical", "apples to apples") })
+	expect("TOPIC #magical :apples to apples")
+	fmt.Fprint(conn, ":magicalbot!bot@example.org TOPIC #magical :apples to apples\r\n")
+	if err := <-done; err != nil {
+		t.Errorf("SetTopic: %v", err)
+	}
+	// no reply at all is a failure, except for modes
+	if err := c.Kick("#magical", "bob", ""); err == nil {
+		t.Error("Kick with no reply succeeded")
+	}
+	expect("KICK #magical bob :")
+	if err := c.SetMode("#magical", "+mv", "bob"); err != nil {
+		t.Errorf("SetMode: %v", err)
+	}
+	expect("MODE #magical +mv bob")
+
+	// nothing can smuggle in another command
+	if err := c.Kick("#magical", "bob", "bye\r\nQUIT :pwned"); err == nil {
+		t.Error("Kick sent a reason with a line break")
+	}
+	if err := c.SetTopic("#magical", "a\x00b"); err == nil {
+		t.Error("SetTopic sent a topic with a NUL")
+	}
+	if err := c.SetMode("#magical", "+b", "x\nPRIVMSG #magical :hi"); err == nil {
+		t.Error("SetMode sent an argument with a line break")
+	}
+	if err := c.SetMode("#magical", "+o", "bob magicalbot"); err == nil {
+		t.Error("SetMode sent an argument with a space")
+	}
+	if err := c.Send("bob", "hi\r\nQUIT :pwned"); err == nil {
+		t.Error("Send sent a message with a line break")
+	}
+	if err := c.Send("bob\r\nQUIT", "hi"); err == nil {
+		t.Error("Send sent to a target with a line break")
+	}
+	if err := c.Notice("bob", "hi\nQUIT"); err == nil {
+		t.Error("Notice sent a message with a line break")
+	}
+	if err := c.Action("#magical", "waves\x00"); err == nil {
+		t.Error("Action sent text with a NUL")
+	}
+	if err := c.Respond(&Message{Room: "#magical", From: "bob"}, "ok\rQUIT"); err == nil {
+		t.Error("Respond sent a response with a line break")
+	}
+	if err := c.Respond(&Message{Room: "#magical", From: "bob :x"}, "ok"); err == nil {
+		t.Error("Respond addressed a nick with a space")
+	}
+	if err := c.Send("bob", "hi"); err != nil {
+		t.Errorf("Send: %v", err)
+	}
+	expect("PRIVMSG bob :hi")
+
+	fmt.Fprint(conn, ":ChanServ!service@services. MODE #magical +v-o bob magicalbot\r\n")
+	sync()
+	if c.IsOp("#magical") {
+		t.Error("still op after -o")
+	}
+	fmt.Fprint(conn, ":ChanServ!service@services. MODE #magical +lo 10 magicalbot\r\n")
+	sync()
+	if !c.IsOp("#magical") {
+		t.Error("not op after +o")
+	}
+	fmt.Fprint(conn, ":bob!b@bob.example.com PRIVMSG #magical :brb\r\n")
+	fmt.Fprint(conn, ":bob!b@bob.example.com QUIT :Quit: brb\r\n")
+	receive(t, messages)
+	receive(t, messages)
+	if mask := c.hostmask("bob"); mask != "bob" {
+		t.Errorf("hostmask after quit = %q", mask)
+	}
+
+	fmt.Fprint(conn, ":carol!c@carol.example.com JOIN #magical\r\n")
+	receive(t, messages)
+	fmt.Fprint(conn, ":magicalbot!bot@example.org PART #magical\r\n")
+	receive(t, messages)
+	if c.IsOp("#magical") {
+		t.Error("still op after leaving")
+	}
+	if mask := c.hostmask("carol"); mask != "carol" {
+		t.Errorf("hostmask after we left = %q", mask)
+	}
+}
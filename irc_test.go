@@ -0,0 +1,260 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenIRC accepts one connection on l and reports the first line
+// the client sends after asking for capabilities, or an error.
+func listenIRC(l net.Listener) <-chan string {
+	first := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			first <- err.Error()
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				first <- err.Error()
+				return
+			}
+			if !strings.HasPrefix(line, "CAP ") {
+				first <- strings.TrimSpace(line)
+				return
+			}
+		}
+	}()
+	return first
+}
+
+func TestIRCPlain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := listenIRC(l)
+	c, err := DialIRC("irc://"+l.Addr().String()+"/magical", make(chan *Message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if line := <-first; !strings.HasPrefix(line, "USER ") {
+		t.Errorf("first line = %q, want USER", line)
+	}
+	if s := c.String(); !strings.Contains(s, "plain text") {
+		t.Errorf("String() = %q", s)
+	}
+	if _, err := DialIRC("irc://"+l.Addr().String()+"?insecure=true", nil); err == nil {
+		t.Error("DialIRC accepted TLS options for irc://")
+	}
+}
+
+// writeTestCert writes a self-signed client certificate and key to dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "magicalbot"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestIRCTLS(t *testing.T) {
+	// borrow httptest's certificate, which is good for example.com
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	cert := srv.TLS.Certificates[0]
+	leaf := srv.Certificate()
+	srv.Close()
+	dir := t.TempDir()
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}), 0600)
+	clientCert, clientKey := writeTestCert(t, dir)
+	sum := sha256.Sum256(leaf.Raw)
+	pin := fmt.Sprintf("%X", sum)
+
+	tests := []struct {
+		query  string
+		ok     bool
+		detail string
+	}{
+		{"", false, ""}, // not signed by a system root
+		{"ca=" + ca, true, "ca="},
+		{"ca=" + ca + "&servername=wrong.example.net", false, ""},
+		{"ca=" + ca + "&servername=example.com", true, "servername=example.com"},
+		{"fingerprint=" + pin, true, "pinned sha256=" + strings.ToLower(pin)},
+		{"fingerprint=" + strings.Repeat("00", 32), false, ""},
+		{"insecure=true", true, "INSECURE"},
+		{"insecure=true&cert=" + clientCert + "&key=" + clientKey, true, "client cert="},
+		{"cert=" + clientCert, false, ""}, // no key
+	}
+	for _, tt := range tests {
+		var gotClientCert bool
+		l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert,
+			VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+				gotClientCert = len(raw) > 0
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := listenIRC(l)
+		c, err := DialIRC("ircs://"+l.Addr().String()+"/magical?"+tt.query, make(chan *Message))
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: connected, want an error", tt.query)
+				c.Close()
+			}
+			l.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.query, err)
+			l.Close()
+			continue
+		}
+		if line := <-first; !strings.HasPrefix(line, "USER ") {
+			t.Errorf("%s: first line = %q, want USER", tt.query, line)
+		}
+		if s := c.String(); !strings.Contains(s, tt.detail) {
+			t.Errorf("%s: String() = %q, want it to mention %q", tt.query, s, tt.detail)
+		}
+		if want := strings.Contains(tt.query, "cert="); gotClientCert != want {
+			t.Errorf("%s: server got a client certificate: %v, want %v", tt.query, gotClientCert, want)
+		}
+		c.Close()
+	}
+}
+
+func TestIRCCTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	messages := make(chan *Message, 10)
+	c, err := DialIRC("irc://"+l.Addr().String()+"/magical", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn := <-accepted
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	readLine := func() string {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "CAP ") && !strings.HasPrefix(line, "USER ") && !strings.HasPrefix(line, "NICK ") {
+				return line
+			}
+		}
+	}
+
+	fmt.Fprint(conn, ":alice!a@example.com PRIVMSG #magical :\x01ACTION \x02waves\x02\x01\r\n")
+	m := receive(t, messages)
+	if m.Kind != KindAction || m.From != "alice" || m.Room != "#magical" || m.Text != "waves" {
+		t.Errorf("got %+v, want an action from alice", m)
+	}
+	if len(m.Spans) != 1 || !m.Spans[0].Bold {
+		t.Errorf("action spans = %+v, want one bold span", m.Spans)
+	}
+
+	fmt.Fprint(conn, ":bob!b@example.com PRIVMSG magicalbot :\x01VERSION\x01\r\n")
+	if line := readLine(); line != "NOTICE bob :\x01VERSION "+ctcpVersion+"\x01" {
+		t.Errorf("VERSION reply = %q", line)
+	}
+	fmt.Fprint(conn, ":bob!b@example.com PRIVMSG magicalbot :\x01PING 12345\x01\r\n")
+	if line := readLine(); line != "NOTICE bob :\x01PING 12345\x01" {
+		t.Errorf("PING reply = %q", line)
+	}
+	fmt.Fprint(conn, ":bob!b@example.com PRIVMSG magicalbot :\x01TIME\x01\r\n")
+	if line := readLine(); !strings.HasPrefix(line, "NOTICE bob :\x01TIME ") {
+		t.Errorf("TIME reply = %q", line)
+	}
+	// the burst is used up, so this one goes unanswered
+	fmt.Fprint(conn, ":bob!b@example.com PRIVMSG magicalbot :\x01VERSION\x01\r\n")
+
+	if err := c.Action("#magical", "bows"); err != nil {
+		t.Fatal(err)
+	}
+	if line := readLine(); line != "PRIVMSG #magical :\x01ACTION bows\x01" {
+		t.Errorf("Action sent %q", line)
+	}
+
+	// notices from people are passed on, but not from the server,
+	// and CTCP replies are dropped
+	fmt.Fprint(conn, ":irc.example.net NOTICE * :*** Looking up your hostname\r\n")
+	fmt.Fprint(conn, ":bob!b@example.com NOTICE magicalbot :\x01VERSION irssi\x01\r\n")
+	fmt.Fprint(conn, ":bob!b@example.com NOTICE #magical :hi all\r\n")
+	m = receive(t, messages)
+	if m.Kind != KindNotice || m.From != "bob" || m.Room != "#magical" || m.Text != "hi all" {
+		t.Errorf("got %+v, want a notice from bob", m)
+	}
+	if err := c.Notice("bob", "your hand"); err != nil {
+		t.Fatal(err)
+	}
+	if line := readLine(); line != "NOTICE bob :your hand" {
+		t.Errorf("Notice sent %q", line)
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("CTCP request was passed to handlers: %+v", m)
+	default:
+	}
+}
@@ -0,0 +1,292 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A Dialer makes the network connections for the chat backends.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DefaultDialer is used by backends whose URL has no proxy parameter.
+// If it is nil, connections go through the proxy named by the
+// ALL_PROXY environment variable, if set, and otherwise directly.
+var DefaultDialer Dialer
+
+var direct = &net.Dialer{Timeout: 30 * time.Second}
+
+// dialerFor picks the dialer for a backend URL's query parameters.
+// A proxy parameter names a proxy, as for ProxyDialer,
+// or is "direct" to ignore DefaultDialer and the environment.
+func dialerFor(q url.Values) (Dialer, error) {
+	proxy := q.Get("proxy")
+	if proxy == "" {
+		if DefaultDialer != nil {
+			return DefaultDialer, nil
+		}
+		proxy = os.Getenv("ALL_PROXY")
+		if proxy == "" {
+			proxy = os.Getenv("all_proxy")
+		}
+	}
+	if proxy == "" || proxy == "direct" {
+		return direct, nil
+	}
+	return ProxyDialer(proxy, direct)
+}
+
+// ProxyDialer returns a Dialer which connects through a proxy,
+// using forward to reach the proxy itself. The proxy URL is either
+//
+//	socks5://[USER:PASSWORD@]HOST[:1080]
+//	http://[USER:PASSWORD@]HOST[:8080]
+//
+// for a SOCKS5 proxy or an HTTP proxy which allows CONNECT.
+func ProxyDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if forward == nil {
+		forward = direct
+	}
+	var port string
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		port = "1080"
+	case "http":
+		port = "8080"
+	default:
+		return nil, fmt.Errorf("proxy: unsupported scheme %q", u.Scheme)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "http" {
+		return &httpProxy{addr: addr, user: u.User, forward: forward}, nil
+	}
+	return &socks5Proxy{addr: addr, user: u.User, forward: forward}, nil
+}
+
+// httpClient returns an HTTP client which makes its connections with d.
+func httpClient(d Dialer, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.Dial(network, addr)
+			},
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// httpProxy tunnels connections through an HTTP proxy with CONNECT.
+type httpProxy struct {
+	addr    string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+func (p *httpProxy) String() string {
+	return "http proxy " + p.addr
+}
+
+func (p *httpProxy) Dial(network, addr string) (net.Conn, error) {
+	conn, err := p.forward.Dial("tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.user != nil {
+		password, _ := p.user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// the server has already started talking
+		return &bufferedConn{conn, br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection some of which has been read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// socks5Proxy connects through a SOCKS5 proxy (RFC 1928),
+// with username and password authentication (RFC 1929) if it has a user.
+type socks5Proxy struct {
+	addr    string
+	user    *url.Userinfo
+	forward Dialer
+}
+
+var socks5Errors = []string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (p *socks5Proxy) String() string {
+	return "socks5 proxy " + p.addr
+}
+
+func (p *socks5Proxy) Dial(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: bad port %q", portStr)
+	}
+	conn, err := p.forward.Dial("tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.connect(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *socks5Proxy) connect(conn net.Conn, host string, port uint16) error {
+	// greeting: offer no authentication, or a password if we have one
+	method := byte(0)
+	if p.user != nil {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New("proxy: not a SOCKS5 server")
+	}
+	if reply[1] != method {
+		return errors.New("proxy: SOCKS5 server refused our authentication method")
+	}
+	if method == 2 {
+		user := p.user.Username()
+		password, _ := p.user.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("proxy: SOCKS5 user name or password too long")
+		}
+		msg := []byte{1, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("proxy: SOCKS5 authentication failed")
+		}
+	}
+
+	// connect, by address if we have one and otherwise by name,
+	// so that the proxy does the DNS lookup
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		req = append(req, 1)
+		req = append(req, ip.To4()...)
+	} else if ip != nil {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("proxy: host name too long")
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	}
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], port)
+	req = append(req, b[:]...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		msg := "unknown error"
+		if int(head[1]) < len(socks5Errors) {
+			msg = socks5Errors[head[1]]
+		}
+		return fmt.Errorf("proxy: SOCKS5 connect to %s: %s", net.JoinHostPort(host, strconv.Itoa(int(port))), msg)
+	}
+	// skip the bound address
+	var skip int
+	switch head[3] {
+	case 1:
+		skip = 4
+	case 4:
+		skip = 16
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return errors.New("proxy: bad SOCKS5 reply")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
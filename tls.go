@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// tlsOptions are the TLS settings a connection URL can carry:
+//
+//	ca=FILE             trust the PEM certificates in FILE instead of the system roots
+//	cert=FILE&key=FILE  present a client certificate
+//	servername=NAME     check the server's certificate against NAME instead of the host
+//	fingerprint=HEX     accept only the certificate with this SHA-256 fingerprint
+//	insecure=true       accept any certificate at all
+//
+// A pinned fingerprint replaces the usual chain verification,
+// so that a self-signed certificate can be trusted.
+type tlsOptions struct {
+	CA          string
+	Cert, Key   string
+	ServerName  string
+	Fingerprint []byte
+	Insecure    bool
+}
+
+var tlsParams = []string{"ca", "cert", "key", "servername", "fingerprint", "insecure"}
+
+// hasTLSOptions reports whether q sets any TLS options.
+func hasTLSOptions(q url.Values) bool {
+	for _, p := range tlsParams {
+		if _, ok := q[p]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTLSOptions(q url.Values) (*tlsOptions, error) {
+	o := &tlsOptions{
+		CA:         q.Get("ca"),
+		Cert:       q.Get("cert"),
+		Key:        q.Get("key"),
+		ServerName: q.Get("servername"),
+	}
+	if (o.Cert == "") != (o.Key == "") {
+		return nil, errors.New("tls: need both cert and key for a client certificate")
+	}
+	if fp := q.Get("fingerprint"); fp != "" {
+		b, err := hex.DecodeString(strings.Replace(fp, ":", "", -1))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("tls: fingerprint %q is not a SHA-256 hash", fp)
+		}
+		o.Fingerprint = b
+	}
+	switch s := q.Get("insecure"); s {
+	case "", "false", "0":
+	case "true", "1":
+		o.Insecure = true
+	default:
+		return nil, fmt.Errorf("tls: bad insecure value %q", s)
+	}
+	return o, nil
+}
+
+// config builds the TLS configuration for connecting to host.
+func (o *tlsOptions) config(host string) (*tls.Config, error) {
+	conf := &tls.Config{ServerName: host}
+	if o.ServerName != "" {
+		conf.ServerName = o.ServerName
+	}
+	if o.CA != "" {
+		pem, err := ioutil.ReadFile(o.CA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificates in %s", o.CA)
+		}
+	}
+	if o.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if o.Fingerprint != nil || o.Insecure {
+		conf.InsecureSkipVerify = true
+	}
+	if o.Fingerprint != nil {
+		want := o.Fingerprint
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("tls: server sent no certificate")
+			}
+			got := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(got[:], want) {
+				return fmt.Errorf("tls: certificate fingerprint %x does not match the pinned one", got)
+			}
+			return nil
+		}
+	}
+	return conf, nil
+}
+
+// String describes the options, for diagnostics.
+func (o *tlsOptions) String() string {
+	var s []string
+	if o.CA != "" {
+		s = append(s, "ca="+o.CA)
+	}
+	if o.Cert != "" {
+		s = append(s, "client cert="+o.Cert)
+	}
+	if o.ServerName != "" {
+		s = append(s, "servername="+o.ServerName)
+	}
+	if o.Fingerprint != nil {
+		s = append(s, fmt.Sprintf("pinned sha256=%x", o.Fingerprint))
+	}
+	if o.Insecure {
+		s = append(s, "INSECURE: certificate not verified")
+	}
+	if len(s) == 0 {
+		return "TLS"
+	}
+	return "TLS: " + strings.Join(s, ", ")
+}
@@ -0,0 +1,107 @@
+package trivia
+
+import (
+	"strings"
+	"unicode"
+)
+
+// normalize lowercases s, drops punctuation and leading articles,
+// and collapses runs of spaces, so that "The Beatles!" matches "beatles".
+func normalize(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return unicode.ToLower(r)
+		case unicode.IsSpace(r) || r == '-':
+			return ' '
+		}
+		return -1
+	}, s)
+	words := strings.Fields(s)
+	if len(words) > 1 {
+		switch words[0] {
+		case "the", "a", "an":
+			words = words[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// matches reports whether guess is close enough to one of the answers.
+// Small typos are forgiven in longer answers, about one per five letters,
+// but numbers must be exact.
+func matches(guess string, answers []string) bool {
+	guess = normalize(guess)
+	if guess == "" {
+		return false
+	}
+	for _, a := range answers {
+		a = normalize(a)
+		if guess == a {
+			return true
+		}
+		if hasDigit(a) {
+			continue
+		}
+		if distance(guess, a) <= len([]rune(a))/5 {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDigit(s string) bool {
+	return strings.IndexFunc(s, unicode.IsDigit) >= 0
+}
+
+// distance returns the Levenshtein distance between a and b.
+func distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	row := make([]int, len(t)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			cur := min3(row[j]+1, row[j-1]+1, prev+cost)
+			prev, row[j] = row[j], cur
+		}
+	}
+	return row[len(t)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// hint returns answer with all but the first n letters
+// of each word replaced by underscores.
+func hint(answer string, n int) string {
+	var b strings.Builder
+	shown := 0
+	for _, r := range answer {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			b.WriteRune(r)
+			shown = 0
+		case shown < n:
+			b.WriteRune(r)
+			shown++
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,85 @@
+package trivia
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Question is a trivia question with one or more accepted answers.
+// The first answer is the one shown in hints and when time runs out.
+type Question struct {
+	Text    string
+	Answers []string
+}
+
+// A Pack is a named set of questions, loaded from a file.
+type Pack struct {
+	Name      string
+	Questions []Question
+}
+
+// LoadPack reads a question pack from a file.
+// The pack is named after the file, without its extension.
+//
+// Each line of the file is a question followed by its answers,
+// separated by asterisks:
+//
+//	What is the capital of Australia?*Canberra
+//	Who wrote "Hamlet"?*William Shakespeare*Shakespeare
+//
+// Blank lines and lines starting with # are ignored.
+func LoadPack(filename string) (*Pack, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	p := &Pack{Name: name}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "*")
+		var q Question
+		q.Text = strings.TrimSpace(fields[0])
+		for _, a := range fields[1:] {
+			if a = strings.TrimSpace(a); a != "" {
+				q.Answers = append(q.Answers, a)
+			}
+		}
+		if q.Text == "" || len(q.Answers) == 0 {
+			return nil, fmt.Errorf("%s:%d: want question*answer", filename, n)
+		}
+		p.Questions = append(p.Questions, q)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// LoadPacks reads every .txt file in dir as a question pack.
+// The packs are sorted by name.
+func LoadPacks(dir string) ([]*Pack, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	var packs []*Pack
+	for _, file := range files {
+		p, err := LoadPack(file)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	return packs, nil
+}
@@ -0,0 +1,48 @@
+package trivia
+
+import (
+	"encoding/json"
+
+	"github.com/magical/chat"
+)
+
+// savedGame is the serialized form of a Game.
+// The phase, host and so on are saved by the games.Table.
+type savedGame struct {
+	Pack      string `json:",omitempty"`
+	Questions []Question
+	Current   int
+	Hints     int
+	Scores    map[string]int
+	Totals    map[string]int
+	Names     map[string]chat.Person
+}
+
+// MarshalJSON implements json.Marshaler, so that the table can save the game.
+func (g *Game) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&savedGame{
+		Pack:      g.pack,
+		Questions: g.questions,
+		Current:   g.current,
+		Hints:     g.hints,
+		Scores:    g.scores,
+		Totals:    g.totals,
+		Names:     g.names,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, so that the table can restore the game.
+func (g *Game) UnmarshalJSON(data []byte) error {
+	var s savedGame
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	g.pack = s.Pack
+	g.questions = s.Questions
+	g.current = s.Current
+	g.hints = s.Hints
+	g.scores = s.Scores
+	g.totals = s.Totals
+	g.names = s.Names
+	return nil
+}
@@ -0,0 +1,373 @@
+// Package trivia implements a chat handler which asks trivia questions.
+package trivia
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+)
+
+// Game is a game of trivia. It implements chat.Handler.
+//
+// Anyone in the room can answer; there is no need to join.
+// Whoever starts the game is its host, and can stop it early.
+// Commands are prefixed with "trivia", so that trivia can share
+// a room with other games: "magicalbot: trivia start".
+type Game struct {
+	// Dir is the directory containing the question packs.
+	// See LoadPack for the format.
+	Dir string
+
+	// Store, if not nil, is where the game is saved between questions.
+	Store games.Store
+
+	// Source, if not nil, is used to choose the questions.
+	Source rand.Source
+
+	// Questions is how many questions are asked in a game.
+	// The default is 10.
+	Questions int
+
+	// TimeLimit is how long players have to answer each question.
+	// The default is one minute.
+	TimeLimit time.Duration
+
+	// Hints is how many hints are given as time runs out.
+	// The default is 2; a negative number means no hints.
+	Hints int
+
+	// Pause is how long to wait between questions.
+	// The default is 5 seconds.
+	Pause time.Duration
+
+	once      sync.Once
+	table     *games.Table
+	pack      string     // the chosen pack, or "" for all of them
+	questions []Question // the questions for this game
+	current   int        // index of the question being asked
+	hints     int        // how many hints have been given for this question
+	scores    map[string]int
+	totals    map[string]int // scores across all games
+	names     map[string]chat.Person
+}
+
+// commands:
+// start - start a game (the table handles this)
+// stop - the host ends the game early
+// packs - list the question packs
+// pack name - choose a pack for the next game, or "all"
+// scores - show the scores for the current game
+// top - show the highest scores across all games
+
+// Table returns the table the game is played at.
+// It takes Store and Source when it is first made;
+// changing them after that has no effect.
+func (g *Game) Table() *games.Table {
+	g.once.Do(func() {
+		g.table = &games.Table{
+			Rules:      g,
+			Name:       "trivia",
+			Store:      g.Store,
+			MinPlayers: 1,
+			Source:     g.Source,
+		}
+	})
+	return g.table
+}
+
+// Event implements chat.Handler.
+func (g *Game) Event(b *chat.Bot, m *chat.Message) {
+	g.Table().Event(b, m)
+}
+
+// Restore loads the game from g.Store. See games.Table.Restore.
+func (g *Game) Restore() error {
+	return g.Table().Restore()
+}
+
+func (g *Game) numQuestions() int {
+	if g.Questions > 0 {
+		return g.Questions
+	}
+	return 10
+}
+
+func (g *Game) timeLimit() time.Duration {
+	if g.TimeLimit > 0 {
+		return g.TimeLimit
+	}
+	return time.Minute
+}
+
+func (g *Game) numHints() int {
+	switch {
+	case g.Hints < 0:
+		return 0
+	case g.Hints == 0:
+		return 2
+	}
+	return g.Hints
+}
+
+func (g *Game) pause() time.Duration {
+	if g.Pause > 0 {
+		return g.Pause
+	}
+	return 5 * time.Second
+}
+
+// Command implements games.Rules.
+func (g *Game) Command(t *games.Table, m *chat.Message, cmd, arg string) error {
+	switch cmd {
+	case "stop":
+		if t.Phase() == "" {
+			return errors.New("there is no game in progress")
+		}
+		if !t.IsMod(m.From) {
+			return fmt.Errorf("only the host (%s) can do that", t.Mod())
+		}
+		t.Announce("trivia has been stopped")
+		t.End()
+		return nil
+	case "packs":
+		packs, err := LoadPacks(g.Dir)
+		if err != nil {
+			return err
+		}
+		if len(packs) == 0 {
+			return errors.New("there are no question packs")
+		}
+		var s []string
+		for _, p := range packs {
+			s = append(s, fmt.Sprintf("%s (%d)", p.Name, len(p.Questions)))
+		}
+		t.Reply(m, "packs: "+strings.Join(s, ", "))
+		return nil
+	case "pack":
+		if t.Phase() != "" {
+			return errors.New("a game is already in progress")
+		}
+		if t.Mod() != "" && !t.IsMod(m.From) {
+			return fmt.Errorf("only the host (%s) can do that", t.Mod())
+		}
+		if arg == "" || arg == "all" {
+			g.pack = ""
+			t.Reply(m, "okay, questions will come from every pack")
+			return nil
+		}
+		if _, err := g.load(arg); err != nil {
+			return err
+		}
+		g.pack = arg
+		t.Reply(m, "okay")
+		return nil
+	case "scores":
+		if len(g.scores) == 0 {
+			t.Reply(m, "nobody has scored yet")
+			return nil
+		}
+		t.Reply(m, "scores: "+g.ranking(g.scores, 0))
+		return nil
+	case "top":
+		if len(g.totals) == 0 {
+			t.Reply(m, "nobody has scored yet")
+			return nil
+		}
+		t.Reply(m, "top scores: "+g.ranking(g.totals, 5))
+		return nil
+	}
+	return games.ErrUnknownCommand
+}
+
+// load returns the questions from the named pack,
+// or from every pack if name is empty.
+func (g *Game) load(name string) ([]Question, error) {
+	if name != "" {
+		if strings.ContainsAny(name, `/\.`) {
+			return nil, errors.New("no such pack")
+		}
+		p, err := LoadPack(filepath.Join(g.Dir, name+".txt"))
+		if err != nil {
+			return nil, errors.New("no such pack")
+		}
+		return p.Questions, nil
+	}
+	packs, err := LoadPacks(g.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var questions []Question
+	for _, p := range packs {
+		questions = append(questions, p.Questions...)
+	}
+	return questions, nil
+}
+
+// Start implements games.Rules.
+func (g *Game) Start(t *games.Table) error {
+	questions, err := g.load(g.pack)
+	if err != nil {
+		return err
+	}
+	if len(questions) == 0 {
+		return errors.New("there are no questions")
+	}
+	t.Rand().Shuffle(len(questions), func(i, j int) {
+		questions[i], questions[j] = questions[j], questions[i]
+	})
+	if n := g.numQuestions(); len(questions) > n {
+		questions = questions[:n]
+	}
+	g.questions = questions
+	g.current = 0
+	g.scores = make(map[string]int)
+	t.Announce(fmt.Sprintf("trivia time! %d questions, %s to answer each", len(g.questions), g.timeLimit()))
+	g.ask(t)
+	return nil
+}
+
+// ask asks the current question.
+func (g *Game) ask(t *games.Table) {
+	g.hints = 0
+	t.SetPhase("question", g.hintTime())
+	g.announceQuestion(t)
+}
+
+func (g *Game) announceQuestion(t *games.Table) {
+	t.Announce(fmt.Sprintf("question %d/%d: %s", g.current+1, len(g.questions), g.questions[g.current].Text))
+}
+
+// hintTime returns how long to wait before the next hint,
+// splitting the time limit evenly between the hints.
+func (g *Game) hintTime() time.Duration {
+	return g.timeLimit() / time.Duration(g.numHints()+1)
+}
+
+// Hear implements games.Listener. Any message in the room
+// might be an answer to the current question.
+func (g *Game) Hear(t *games.Table, m *chat.Message) {
+	if t.Phase() != "question" || t.Paused() {
+		return
+	}
+	q := g.questions[g.current]
+	if !matches(m.Text, q.Answers) {
+		return
+	}
+	points := g.numHints() + 1 - g.hints
+	id := t.Identity(m)
+	if g.scores == nil {
+		g.scores = make(map[string]int)
+	}
+	if g.totals == nil {
+		g.totals = make(map[string]int)
+	}
+	if g.names == nil {
+		g.names = make(map[string]chat.Person)
+	}
+	g.scores[id] += points
+	g.totals[id] += points
+	g.names[id] = m.From
+	t.Announce(fmt.Sprintf("%s got it! the answer was %s (+%d, %d total)", m.From, q.Answers[0], points, g.scores[id]))
+	g.next(t)
+}
+
+// next moves on to the next question after a pause,
+// or ends the game if that was the last one.
+func (g *Game) next(t *games.Table) {
+	if g.current+1 >= len(g.questions) {
+		t.End()
+		return
+	}
+	t.SetPhase("break", g.pause())
+}
+
+// Timeout implements games.Rules.
+// While a question is being asked, each timeout gives a hint
+// until there are none left and time is up.
+func (g *Game) Timeout(t *games.Table, phase string) {
+	switch phase {
+	case "question":
+		q := g.questions[g.current]
+		if g.hints < g.numHints() {
+			g.hints++
+			t.SetPhase("question", g.hintTime())
+			t.Announce("hint: " + hint(q.Answers[0], g.hints))
+			return
+		}
+		t.Announce("time's up! the answer was " + q.Answers[0])
+		g.next(t)
+	case "break":
+		g.current++
+		g.ask(t)
+	}
+}
+
+// Leave implements games.Rules. Only the host is a player,
+// so this only happens when the host passes their role on.
+func (g *Game) Leave(t *games.Table, p chat.Person) {}
+
+// Stop implements games.Rules.
+func (g *Game) Stop(t *games.Table) {
+	t.Announce("trivia over!")
+	if len(g.scores) == 0 {
+		t.Announce("nobody scored")
+	} else {
+		t.Announce("scores: " + g.ranking(g.scores, 0))
+	}
+	g.questions = nil
+	g.current = 0
+}
+
+// Status implements games.Rules.
+func (g *Game) Status(t *games.Table) string {
+	if t.Phase() == "break" {
+		return fmt.Sprintf("question %d/%d is next", g.current+2, len(g.questions))
+	}
+	return fmt.Sprintf("question %d/%d: %s", g.current+1, len(g.questions), g.questions[g.current].Text)
+}
+
+// Resume implements games.Rules.
+func (g *Game) Resume(t *games.Table) {
+	if t.Phase() == "question" {
+		g.announceQuestion(t)
+		if g.hints > 0 {
+			t.Announce("hint: " + hint(g.questions[g.current].Answers[0], g.hints))
+		}
+	}
+}
+
+// ranking returns scores from highest to lowest, at most n of them
+// if n is positive.
+func (g *Game) ranking(scores map[string]int, n int) string {
+	var ids []string
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if scores[ids[i]] != scores[ids[j]] {
+			return scores[ids[i]] > scores[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if n > 0 && len(ids) > n {
+		ids = ids[:n]
+	}
+	var s []string
+	for _, id := range ids {
+		name := g.names[id]
+		if name == "" {
+			name = chat.Person(id)
+		}
+		s = append(s, string(name)+": "+strconv.Itoa(scores[id]))
+	}
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,168 @@
+package trivia
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+	"github.com/magical/chat/internal/chattest"
+)
+
+func writePack(t *testing.T, dir, name, text string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".txt"), []byte(text), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadPacks(t *testing.T) {
+	dir := t.TempDir()
+	writePack(t, dir, "science", "# a comment\nWhat is H2O?*water\n\nHow many legs does a spider have?*8*eight\n")
+	writePack(t, dir, "music", "Who sang Thriller?*Michael Jackson\n")
+	packs, err := LoadPacks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packs) != 2 || packs[0].Name != "music" || packs[1].Name != "science" {
+		t.Fatalf("got packs %v", packs)
+	}
+	q := packs[1].Questions[1]
+	if q.Text != "How many legs does a spider have?" || len(q.Answers) != 2 || q.Answers[1] != "eight" {
+		t.Errorf("got question %+v", q)
+	}
+
+	writePack(t, dir, "broken", "What is missing?\n")
+	if _, err := LoadPacks(dir); err == nil || !strings.Contains(err.Error(), "broken.txt:1") {
+		t.Errorf("LoadPacks with a bad line: err = %v", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		guess, answer string
+		want          bool
+	}{
+		{"canberra", "Canberra", true},
+		{"Canbera", "Canberra", true},
+		{"sydney", "Canberra", false},
+		{"beatles", "The Beatles", true},
+		{"the beatles!", "Beatles", true},
+		{"michael jakson", "Michael Jackson", true},
+		{"1984", "1984", true},
+		{"1985", "1984", false},
+		{"", "anything", false},
+		{"cat", "bat", false},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.guess, []string{tt.answer}); got != tt.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", tt.guess, tt.answer, got, tt.want)
+		}
+	}
+}
+
+func TestHint(t *testing.T) {
+	tests := []struct {
+		answer string
+		n      int
+		want   string
+	}{
+		{"Michael Jackson", 0, "_______ _______"},
+		{"Michael Jackson", 1, "M______ J______"},
+		{"Michael Jackson", 2, "Mi_____ Ja_____"},
+		{"R2-D2", 1, "R_-D_"},
+	}
+	for _, tt := range tests {
+		if got := hint(tt.answer, tt.n); got != tt.want {
+			t.Errorf("hint(%q, %d) = %q, want %q", tt.answer, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestGame(t *testing.T) {
+	dir := t.TempDir()
+	writePack(t, dir, "capitals", "Capital of France?*Paris\nCapital of Japan?*Tokyo\nCapital of Peru?*Lima\n")
+	g := &Game{Dir: dir, Questions: 2, Source: rand.NewSource(1)}
+	b, _ := chat.NewBot()
+	conn := new(chattest.Conn)
+	b.AddConn(conn)
+	say := func(from chat.Person, text string) {
+		g.Event(b, &chat.Message{Conn: conn, From: from, Room: "#trivia", Text: text})
+	}
+	answer := func() string {
+		q := g.questions[g.current].Text
+		return map[string]string{"Capital of France?": "paris", "Capital of Japan?": "tokio", "Capital of Peru?": "Lima"}[q]
+	}
+
+	say("alice", "magicalbot: start")
+	if g.Table().Phase() != "" {
+		t.Fatalf("a trivia game started without the trivia prefix")
+	}
+	say("alice", "magicalbot: trivia start")
+	if g.Table().Phase() != "question" || !g.Table().IsMod("alice") {
+		t.Fatalf("game didn't start: %q", conn.Sent)
+	}
+	if !conn.Said("#trivia", "question 1/2") {
+		t.Errorf("question wasn't asked: %q", conn.Sent)
+	}
+
+	// a wrong answer, then two hints, then a right one
+	say("bob", "no idea")
+	g.Table().Expire()
+	g.Table().Expire()
+	if !conn.Said("#trivia", "hint: ") {
+		t.Errorf("no hint was given: %q", conn.Sent)
+	}
+	say("bob", answer())
+	if g.scores["bob"] != 1 || g.Table().Phase() != "break" {
+		t.Errorf("bob's score = %d, phase = %q; want 1, break", g.scores["bob"], g.Table().Phase())
+	}
+
+	// bob can't stop alice's game
+	say("bob", "magicalbot: trivia stop")
+	if !conn.Said("bob", "only the host") {
+		t.Errorf("bob stopped the game")
+	}
+
+	g.Table().Expire()
+	if !conn.Said("#trivia", "question 2/2") {
+		t.Fatalf("second question wasn't asked: %q", conn.Sent)
+	}
+	say("carol", answer())
+	if g.scores["carol"] != 3 {
+		t.Errorf("carol answered without hints but scored %d", g.scores["carol"])
+	}
+	if g.Table().Phase() != "" || !conn.Said("#trivia", "scores: carol: 3, bob: 1") {
+		t.Errorf("game didn't end after the last question: %q", conn.Sent)
+	}
+}
+
+func TestTimesUp(t *testing.T) {
+	dir := t.TempDir()
+	writePack(t, dir, "one", "Capital of Peru?*Lima\n")
+	store := games.FileStore(filepath.Join(t.TempDir(), "trivia.json"))
+	g := &Game{Dir: dir, Store: store, Hints: -1}
+	b, _ := chat.NewBot()
+	conn := new(chattest.Conn)
+	b.AddConn(conn)
+	g.Event(b, &chat.Message{Conn: conn, From: "alice", Room: "#trivia", Text: "magicalbot: trivia start"})
+
+	// the game survives a restart
+	h := &Game{Dir: dir, Store: store, Hints: -1}
+	if err := h.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	h.Event(b, &chat.Message{Conn: conn, Kind: chat.KindJoin, From: "magicalbot", Room: "#trivia"})
+	if h.Table().Phase() != "question" || len(h.questions) != 1 {
+		t.Fatalf("restored phase = %q with %d questions", h.Table().Phase(), len(h.questions))
+	}
+	h.Table().Expire()
+	if !conn.Said("#trivia", "time's up! the answer was Lima") || h.Table().Phase() != "" {
+		t.Errorf("time ran out, but the game didn't end: %q", conn.Sent)
+	}
+	if !conn.Said("#trivia", "nobody scored") {
+		t.Errorf("final scores weren't announced: %q", conn.Sent)
+	}
+}
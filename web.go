@@ -0,0 +1,318 @@
+package chat
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// WebConn serves a WebSocket endpoint for programs which want to talk
+// to the bot without speaking IRC. Clients send and receive JSON objects:
+//
+//	{"from": "alice", "room": "#games", "text": "magicalbot: start"}
+//
+// A message without a room is private. A client may also send
+// {"type": "join", ...} or {"type": "part", ...} to enter or leave a room,
+// and notices, which bots don't reply to, have {"type": "notice"}.
+// Messages for a room go to every client which has joined or spoken in it,
+// and messages for a person to every client which has spoken as them.
+type WebConn struct {
+	tokens      []string
+	nick        string
+	listener    net.Listener
+	messageChan chan<- *Message
+
+	mu      sync.Mutex
+	clients map[*webClient]bool
+	closed  bool
+}
+
+type webClient struct {
+	ws     *wsConn
+	rooms  map[Room]bool   // protected by WebConn.mu
+	people map[Person]bool // protected by WebConn.mu
+}
+
+// webMessage is the JSON form of a message, in either direction.
+type webMessage struct {
+	Type  string `json:"type,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+	Room  string `json:"room,omitempty"`
+	Text  string `json:"text,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func init() {
+	RegisterScheme("web", func(rawurl string, messageChan chan<- *Message) (Conn, error) {
+		c, err := DialWeb(rawurl, messageChan)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	})
+}
+
+// DialWeb starts serving WebSocket clients. The URL has the form
+//
+//	web://LISTEN_ADDR/PATH?token=SECRET
+//
+// Clients must give one of the tokens, either in an Authorization
+// header as "Bearer SECRET" or in a token query parameter.
+// The nick parameter sets the name the bot's own messages come from.
+func DialWeb(rawurl string, messageChan chan<- *Message) (*WebConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "web" {
+		return nil, errors.New("DialWeb: scheme must be web://")
+	}
+	q := u.Query()
+	c := &WebConn{
+		tokens:      q["token"],
+		nick:        q.Get("nick"),
+		messageChan: messageChan,
+		clients:     make(map[*webClient]bool),
+	}
+	if len(c.tokens) == 0 {
+		return nil, errors.New("DialWeb: need at least one token")
+	}
+	if c.nick == "" {
+		c.nick = "magicalbot"
+	}
+	ln, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, c.serve)
+	c.listener = ln
+	go http.Serve(ln, mux)
+	return c, nil
+}
+
+// Addr returns the address clients connect to.
+func (c *WebConn) Addr() net.Addr {
+	return c.listener.Addr()
+}
+
+// authorized reports whether r carries one of our tokens.
+func (c *WebConn) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	ok := false
+	for _, t := range c.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (c *WebConn) serve(w http.ResponseWriter, r *http.Request) {
+	if !c.authorized(r) {
+		http.Error(w, "bad token", http.StatusUnauthorized)
+		return
+	}
+	ws, err := acceptWebsocket(w, r)
+	if err != nil {
+		log.Printf("web: %v", err)
+		return
+	}
+	client := &webClient{ws: ws, rooms: make(map[Room]bool), people: make(map[Person]bool)}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		ws.Close()
+		return
+	}
+	c.clients[client] = true
+	c.mu.Unlock()
+
+	err = c.readClient(client)
+	ws.Close()
+	c.mu.Lock()
+	if _, ok := err.(*wsCloseError); !ok && !c.closed {
+		log.Printf("web: %v", err)
+	}
+	delete(c.clients, client)
+	var gone []Person
+	for p := range client.people {
+		if !c.speaksAs(p) {
+			gone = append(gone, p)
+		}
+	}
+	c.mu.Unlock()
+	// people nobody is speaking for any more have quit
+	for _, p := range gone {
+		c.messageChan <- &Message{Conn: c, Kind: KindQuit, From: p}
+	}
+}
+
+// speaksAs reports whether any client has spoken as p.
+// The caller must hold c.mu.
+func (c *WebConn) speaksAs(p Person) bool {
+	for client := range c.clients {
+		if client.people[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// readClient turns a client's JSON into Messages until it disconnects.
+func (c *WebConn) readClient(client *webClient) error {
+	for {
+		_, data, err := client.ws.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var wm webMessage
+		if err := json.Unmarshal(data, &wm); err != nil {
+			// tell the client, and carry on
+			client.ws.WriteJSON(webMessage{Error: err.Error()})
+			continue
+		}
+		m, err := c.message(client, &wm)
+		if err != nil {
+			client.ws.WriteJSON(webMessage{Error: err.Error()})
+			continue
+		}
+		if m != nil {
+			c.messageChan <- m
+		}
+	}
+}
+
+// message maps a client's message onto a Message,
+// the same way IRCConn.handlePrivmsg does.
+func (c *WebConn) message(client *webClient, wm *webMessage) (*Message, error) {
+	if wm.From == "" {
+		return nil, errors.New("missing from")
+	}
+	var m Message
+	m.Conn = c
+	m.From = Person(wm.From)
+	m.Room = Room(wm.Room)
+	c.mu.Lock()
+	client.people[m.From] = true
+	if m.Room != "" {
+		client.rooms[m.Room] = true
+	}
+	c.mu.Unlock()
+	switch wm.Type {
+	case "", "message":
+		if wm.From == c.nick {
+			log.Printf("ignoring message from self: %q", wm.Text)
+			return nil, nil
+		}
+		m.RawText = wm.Text
+		m.Text = wm.Text
+	case "notice":
+		m.Kind = KindNotice
+		m.RawText = wm.Text
+		m.Text = wm.Text
+	case "join":
+		m.Kind = KindJoin
+	case "part":
+		m.Kind = KindPart
+		c.mu.Lock()
+		delete(client.rooms, m.Room)
+		c.mu.Unlock()
+	default:
+		return nil, errors.New("unknown type " + wm.Type)
+	}
+	if (m.Kind == KindJoin || m.Kind == KindPart) && m.Room == "" {
+		return nil, errors.New("missing room")
+	}
+	return &m, nil
+}
+
+// deliver sends wm to every client interested in to.
+func (c *WebConn) deliver(to string, wm webMessage) error {
+	c.mu.Lock()
+	var clients []*webClient
+	for client := range c.clients {
+		if client.rooms[Room(to)] || client.people[Person(to)] {
+			clients = append(clients, client)
+		}
+	}
+	c.mu.Unlock()
+	if len(clients) == 0 {
+		log.Printf("web: nobody to deliver to %s: %q", to, wm.Text)
+		return errors.New("web: no client for " + to)
+	}
+	wm.Text = StripFormatting(wm.Text)
+	var err error
+	for _, client := range clients {
+		if werr := client.ws.WriteJSON(wm); werr != nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// Send sends a message to a room or a person.
+func (c *WebConn) Send(to Person, message string) error {
+	return c.send("", to, message)
+}
+
+// Notice sends a notice to a room or a person.
+func (c *WebConn) Notice(to Person, message string) error {
+	return c.send("notice", to, message)
+}
+
+func (c *WebConn) send(typ string, to Person, message string) error {
+	wm := webMessage{Type: typ, From: c.nick, Text: message}
+	c.mu.Lock()
+	for client := range c.clients {
+		if client.rooms[Room(to)] {
+			wm.Room = string(to)
+		}
+	}
+	c.mu.Unlock()
+	if wm.Room == "" {
+		wm.To = string(to)
+	}
+	return c.deliver(string(to), wm)
+}
+
+func (c *WebConn) Respond(m *Message, response string) error {
+	if m.Room != "" {
+		return c.deliver(string(m.Room), webMessage{
+			From: c.nick,
+			To:   string(m.From),
+			Room: string(m.Room),
+			Text: string(m.From) + ": " + response,
+		})
+	}
+	if string(m.From) == c.nick {
+		log.Printf("error: tried to send message to self: %q", response)
+		return errors.New("invalid receiver")
+	}
+	return c.Send(m.From, response)
+}
+
+// Close stops listening and disconnects every client.
+func (c *WebConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for client := range c.clients {
+		client.ws.Close()
+	}
+	return c.listener.Close()
+}
@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readWeb(t *testing.T, ws *wsConn) webMessage {
+	var wm webMessage
+	ws.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := ws.ReadJSON(&wm); err != nil {
+		t.Fatal(err)
+	}
+	return wm
+}
+
+func TestWeb(t *testing.T) {
+	messages := make(chan *Message, 10)
+	c, err := DialWeb("web://127.0.0.1:0/chat?token=secret&token=other", messages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	endpoint := "ws://" + c.Addr().String() + "/chat"
+
+	if _, err := dialWebsocket(endpoint+"?token=wrong", nil, direct); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("connected with a bad token: err = %v", err)
+	}
+	alice, err := dialWebsocket(endpoint, http.Header{"Authorization": {"Bearer secret"}}, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alice.Close()
+	bob, err := dialWebsocket(endpoint+"?token=other", nil, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bob.WriteJSON(webMessage{Type: "join", From: "bob", Room: "#games"})
+	if m := receive(t, messages); m.Kind != KindJoin || m.From != "bob" || m.Room != "#games" {
+		t.Errorf("got %+v, want a join", m)
+	}
+	alice.WriteJSON(webMessage{From: "alice", Room: "#games", Text: "magicalbot: start"})
+	m := receive(t, messages)
+	if m.Kind != KindMessage || m.From != "alice" || m.Room != "#games" || m.Text != "magicalbot: start" {
+		t.Errorf("got message %+v", m)
+	}
+
+	// replies in a room go to everyone in it
+	c.Respond(m, "okay")
+	want := webMessage{From: "magicalbot", To: "alice", Room: "#games", Text: "alice: okay"}
+	if wm := readWeb(t, alice); wm != want {
+		t.Errorf("alice got %+v, want %+v", wm, want)
+	}
+	if wm := readWeb(t, bob); wm != want {
+		t.Errorf("bob got %+v, want %+v", wm, want)
+	}
+
+	// private messages only go to the person
+	alice.WriteJSON(webMessage{From: "alice", Text: "hand"})
+	m = receive(t, messages)
+	if m.Room != "" || m.Text != "hand" {
+		t.Errorf("got %+v, want a private message", m)
+	}
+	c.Respond(m, "your cards")
+	if wm := readWeb(t, alice); wm.To != "alice" || wm.Room != "" || wm.Text != "your cards" {
+		t.Errorf("alice got %+v", wm)
+	}
+	c.Send("#games", "hello")
+	if wm := readWeb(t, bob); wm.Room != "#games" || wm.Text != "hello" {
+		t.Errorf("bob got %+v, not the private message", wm)
+	}
+	readWeb(t, alice)
+
+	alice.WriteJSON(webMessage{Text: "who am I?"})
+	if wm := readWeb(t, alice); wm.Error == "" {
+		t.Errorf("got %+v, want an error", wm)
+	}
+
+	// when bob hangs up, he quits
+	bob.Close()
+	if m := receive(t, messages); m.Kind != KindQuit || m.From != "bob" {
+		t.Errorf("got %+v, want bob quitting", m)
+	}
+}
@@ -0,0 +1,361 @@
+package chat
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// A minimal WebSocket (RFC 6455) implementation,
+// just enough for the chat services which push events over one.
+// Extensions and subprotocols are not supported.
+
+const (
+	wsContinuation = 0
+	wsText         = 1
+	wsBinary       = 2
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxMessage limits the size of messages we are willing to read.
+const wsMaxMessage = 1 << 24
+
+var errWebsocketClosed = errors.New("websocket closed")
+
+// wsCloseError is returned by ReadMessage when the other side
+// closes the connection, with the status code it gave, if any.
+type wsCloseError struct {
+	Code int
+}
+
+func (e *wsCloseError) Error() string {
+	if e.Code == 0 {
+		return "websocket closed"
+	}
+	return fmt.Sprintf("websocket closed with status %d", e.Code)
+}
+
+type wsConn struct {
+	conn   net.Conn
+	br     *bufio.Reader // owned by the reader
+	client bool          // clients mask their frames; servers don't
+
+	wmu    sync.Mutex // protects writes
+	closed bool
+}
+
+// dialWebsocket opens a WebSocket connection to a ws:// or wss:// URL,
+// making the network connection with d.
+func dialWebsocket(rawurl string, header http.Header, d Dialer) (*wsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	var sock net.Conn
+	switch u.Scheme {
+	case "ws":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "80")
+		}
+		sock, err = d.Dial("tcp", host)
+	case "wss":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "443")
+		}
+		if sock, err = d.Dial("tcp", host); err == nil {
+			tlsConn := tls.Client(sock, &tls.Config{ServerName: u.Hostname()})
+			if err = tlsConn.Handshake(); err != nil {
+				sock.Close()
+			}
+			sock = tlsConn
+		}
+	default:
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := websocketHandshake(sock, u, header)
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// websocketHandshake performs the client side of the opening handshake over sock.
+func websocketHandshake(sock net.Conn, u *url.URL, header http.Header) (*wsConn, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(sock); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(sock)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket: handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		return nil, errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+	return &wsConn{conn: sock, br: br, client: true}, nil
+}
+
+// acceptWebsocket upgrades an HTTP request to a WebSocket connection.
+func acceptWebsocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket: not a websocket handshake", http.StatusBadRequest)
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "websocket: unsupported version", http.StatusBadRequest)
+		return nil, errors.New("websocket: unsupported version")
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "websocket: missing key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket: can't hijack connection", http.StatusInternalServerError)
+		return nil, errors.New("websocket: can't hijack connection")
+	}
+	sock, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(key))
+	if err := rw.Flush(); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return &wsConn{conn: sock, br: rw.Reader}, nil
+}
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether any of the comma-separated values
+// of the header key is value, ignoring case.
+func headerContains(h http.Header, key, value string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(key)] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReadMessage returns the next text or binary message.
+// Pings are answered and fragmented messages reassembled.
+// If the other side closes the connection, the error is a *wsCloseError.
+func (c *wsConn) ReadMessage() (op int, data []byte, err error) {
+	for {
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case wsPing:
+			c.writeFrame(wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			c.writeFrame(wsClose, payload)
+			c.conn.Close()
+			var code int
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			return 0, nil, &wsCloseError{Code: code}
+		case wsContinuation:
+			if op == 0 {
+				return 0, nil, errors.New("websocket: unexpected continuation frame")
+			}
+		case wsText, wsBinary:
+			if op != 0 {
+				return 0, nil, errors.New("websocket: expected continuation frame")
+			}
+			op = frameOp
+		default:
+			return 0, nil, fmt.Errorf("websocket: unknown opcode %d", frameOp)
+		}
+		data = append(data, payload...)
+		if len(data) > wsMaxMessage {
+			return 0, nil, errors.New("websocket: message too long")
+		}
+		if fin {
+			return op, data, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, op int, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(c.br, h[:]); err != nil {
+		return
+	}
+	fin = h[0]&0x80 != 0
+	op = int(h[0] & 0x0f)
+	masked := h[1]&0x80 != 0
+	n := uint64(h[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err = io.ReadFull(c.br, b[:]); err != nil {
+			return
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxMessage {
+		err = errors.New("websocket: frame too long")
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, n)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// WriteMessage sends a single unfragmented message.
+func (c *wsConn) WriteMessage(op int, data []byte) error {
+	return c.writeFrame(op, data)
+}
+
+func (c *wsConn) writeFrame(op int, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closed {
+		return errWebsocketClosed
+	}
+	if op == wsClose {
+		c.closed = true
+	}
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|byte(op))
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n < 1<<16:
+		buf = append(buf, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		buf = append(buf, maskBit|127)
+		buf = append(buf, b[:]...)
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// ReadJSON reads the next message and decodes it into v.
+func (c *wsConn) ReadJSON(v interface{}) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteJSON sends v as a JSON text message.
+func (c *wsConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(wsText, data)
+}
+
+// Close sends a close frame and closes the connection.
+func (c *wsConn) Close() error {
+	return c.CloseWith(1000) // normal closure
+}
+
+// CloseWith is like Close, but gives the status code to send.
+func (c *wsConn) CloseWith(code int) error {
+	c.writeFrame(wsClose, []byte{byte(code >> 8), byte(code)})
+	return c.conn.Close()
+}
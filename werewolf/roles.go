@@ -0,0 +1,47 @@
+package werewolf
+
+import "math/rand"
+
+type role string
+
+const (
+	villager role = "villager"
+	werewolf role = "werewolf"
+	seer     role = "seer"   // learns one player's role each night
+	doctor   role = "doctor" // protects one player from the wolves each night
+)
+
+// intro is what each role is told at the start of the game.
+var intro = map[role]string{
+	villager: "You are a villager. Find the werewolves and vote them out during the day.",
+	werewolf: "You are a werewolf. Each night, choose someone to kill: /msg magicalbot werewolf kill [nick]",
+	seer:     "You are the seer. Each night, choose someone to see: /msg magicalbot werewolf see [nick]",
+	doctor:   "You are the doctor. Each night, choose someone to protect: /msg magicalbot werewolf save [nick]",
+}
+
+// deal returns the roles for an n-player game, shuffled.
+// There is one werewolf for every four players and always a seer;
+// games of seven or more also have a doctor.
+func deal(r *rand.Rand, n int) []role {
+	roles := make([]role, n)
+	for i := range roles {
+		roles[i] = villager
+	}
+	wolves := n / 4
+	if wolves < 1 {
+		wolves = 1
+	}
+	i := 0
+	for ; i < wolves; i++ {
+		roles[i] = werewolf
+	}
+	roles[i] = seer
+	i++
+	if n >= 7 {
+		roles[i] = doctor
+	}
+	r.Shuffle(len(roles), func(i, j int) {
+		roles[i], roles[j] = roles[j], roles[i]
+	})
+	return roles
+}
@@ -0,0 +1,54 @@
+package werewolf
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/magical/chat"
+)
+
+// savedGame is the serialized form of a Game.
+// The players, phase and so on are saved by the games.Table.
+type savedGame struct {
+	Roles  map[chat.Person]role
+	Alive  map[chat.Person]bool
+	Round  int
+	Kills  map[chat.Person]chat.Person
+	Seen   bool        `json:",omitempty"`
+	Saving chat.Person `json:",omitempty"`
+	Votes  map[chat.Person]chat.Person
+}
+
+// MarshalJSON implements json.Marshaler, so that the table can save the game.
+func (g *Game) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&savedGame{
+		Roles:  g.roles,
+		Alive:  g.alive,
+		Round:  g.round,
+		Kills:  g.kills,
+		Seen:   g.seen,
+		Saving: g.saving,
+		Votes:  g.votes,
+	})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, so that the table can restore the game.
+func (g *Game) UnmarshalJSON(data []byte) error {
+	var s savedGame
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	for _, r := range s.Roles {
+		if _, ok := intro[r]; !ok {
+			return fmt.Errorf("unknown role in saved game: %q", r)
+		}
+	}
+	g.roles = s.Roles
+	g.alive = s.Alive
+	g.round = s.Round
+	g.kills = s.Kills
+	g.seen = s.Seen
+	g.saving = s.Saving
+	g.votes = s.Votes
+	return nil
+}
@@ -0,0 +1,474 @@
+// Package werewolf implements a chat handler which plays werewolf,
+// a game of hidden roles also known as mafia.
+//
+// Each player is secretly dealt a role over private message.
+// At night the werewolves choose someone to kill,
+// and the seer and doctor use their powers, all over private message.
+// During the day everyone votes in the room on who to lynch.
+// The villagers win when the werewolves are dead;
+// the werewolves win when they equal the villagers.
+package werewolf
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+)
+
+// Game is a game of werewolf. It implements chat.Handler.
+// Commands are prefixed with "werewolf": "magicalbot: werewolf join".
+type Game struct {
+	// Store, if not nil, is where the game is saved after every move.
+	Store games.Store
+
+	// Source, if not nil, is used to deal the roles.
+	Source rand.Source
+
+	// NightTime and DayTime limit how long each phase lasts.
+	// The defaults are two and five minutes.
+	NightTime time.Duration
+	DayTime   time.Duration
+
+	once   sync.Once
+	table  *games.Table
+	roles  map[chat.Person]role
+	alive  map[chat.Person]bool
+	round  int                         // which night or day it is
+	kills  map[chat.Person]chat.Person // werewolf's choice of victim
+	seen   bool                        // whether the seer has looked tonight
+	saving chat.Person                 // who the doctor is protecting, if anyone
+	votes  map[chat.Person]chat.Person
+}
+
+const (
+	minPlayers = 5
+	maxPlayers = 15
+)
+
+// commands, besides the ones every games.Table has:
+// kill nick - a werewolf chooses a victim (over PM, at night)
+// see nick - the seer learns someone's role (over PM, at night)
+// save nick - the doctor protects someone (over PM, at night)
+// vote nick - vote to lynch someone (in the room, during the day)
+// unvote - take back your vote
+// role - remind yourself of your role
+// alive - list the living players
+
+// Table returns the table the game is played at.
+// Store and Source are copied to it on first use.
+func (g *Game) Table() *games.Table {
+	g.once.Do(func() {
+		g.table = &games.Table{
+			Rules:      g,
+			Name:       "werewolf",
+			Store:      g.Store,
+			MinPlayers: minPlayers,
+			MaxPlayers: maxPlayers,
+			// dead players may leave; Leave ends the game when a side has won
+			KeepPlayers: 1,
+			Source:      g.Source,
+		}
+	})
+	return g.table
+}
+
+// Event implements chat.Handler.
+func (g *Game) Event(b *chat.Bot, m *chat.Message) {
+	g.Table().Event(b, m)
+}
+
+// Restore loads the game from g.Store. See games.Table.Restore.
+func (g *Game) Restore() error {
+	return g.Table().Restore()
+}
+
+func (g *Game) nightTime() time.Duration {
+	if g.NightTime > 0 {
+		return g.NightTime
+	}
+	return 2 * time.Minute
+}
+
+func (g *Game) dayTime() time.Duration {
+	if g.DayTime > 0 {
+		return g.DayTime
+	}
+	return 5 * time.Minute
+}
+
+// Start implements games.Rules. It deals the roles and starts the first night.
+func (g *Game) Start(t *games.Table) error {
+	players := t.Players()
+	roles := deal(t.Rand(), len(players))
+	g.roles = make(map[chat.Person]role)
+	g.alive = make(map[chat.Person]bool)
+	for i, p := range players {
+		g.roles[p] = roles[i]
+		g.alive[p] = true
+	}
+	g.round = 0
+	wolves := g.living(werewolf)
+	for _, p := range players {
+		t.Tell(p, intro[g.roles[p]])
+		if g.roles[p] == werewolf && len(wolves) > 1 {
+			t.Tell(p, "The werewolves are: "+games.Names(wolves))
+		}
+	}
+	t.Announce(fmt.Sprintf("the game has begun! %d players, %d werewolves. check your messages for your role",
+		len(players), len(wolves)))
+	g.night(t)
+	return nil
+}
+
+// living returns the living players with the given role,
+// or all of them if r is empty, in turn order.
+func (g *Game) living(r role) []chat.Person {
+	var people []chat.Person
+	for _, p := range g.table.Players() {
+		if g.alive[p] && (r == "" || g.roles[p] == r) {
+			people = append(people, p)
+		}
+	}
+	return people
+}
+
+// Command implements games.Rules.
+func (g *Game) Command(t *games.Table, m *chat.Message, cmd, arg string) error {
+	switch cmd {
+	case "kill", "see", "save", "vote", "unvote", "role":
+	case "alive":
+		if t.Phase() == "" {
+			return errors.New("there is no game in progress")
+		}
+		t.Reply(m, "alive: "+games.Names(g.living("")))
+		return nil
+	default:
+		return games.ErrUnknownCommand
+	}
+	p := m.From
+	if t.Phase() == "" || !t.Playing(p) {
+		return errors.New("you aren't playing")
+	}
+	if cmd == "role" {
+		t.Tell(p, intro[g.roles[p]])
+		return nil
+	}
+	if !g.alive[p] {
+		return errors.New("you're dead")
+	}
+	if t.Paused() {
+		return errors.New("the game is paused")
+	}
+	switch cmd {
+	case "kill", "see", "save":
+		if m.Room != "" {
+			return fmt.Errorf("do that privately: /msg magicalbot werewolf %s [nick]", cmd)
+		}
+		if t.Phase() != "night" {
+			return errors.New("you can only do that at night")
+		}
+		return g.act(t, p, cmd, chat.Person(arg))
+	case "vote":
+		if m.Room == "" {
+			return errors.New("vote in the room")
+		}
+		return g.vote(t, p, chat.Person(arg))
+	case "unvote":
+		if _, ok := g.votes[p]; !ok {
+			return errors.New("you haven't voted")
+		}
+		delete(g.votes, p)
+		t.Reply(m, "okay")
+		return nil
+	}
+	return nil
+}
+
+// night starts the next night.
+func (g *Game) night(t *games.Table) {
+	g.round++
+	g.kills = make(map[chat.Person]chat.Person)
+	g.seen = false
+	g.saving = ""
+	g.votes = nil
+	t.SetPhase("night", g.nightTime())
+	t.Announce(fmt.Sprintf("night %d falls. everyone with a role to play, check your messages", g.round))
+	alive := "The living are: " + games.Names(g.living(""))
+	for _, p := range g.living("") {
+		if g.roles[p] != villager {
+			t.Tell(p, fmt.Sprintf("Night %d. %s", g.round, alive))
+		}
+	}
+}
+
+// act carries out a night action.
+func (g *Game) act(t *games.Table, p chat.Person, action string, target chat.Person) error {
+	if !g.alive[target] {
+		return fmt.Errorf("%s isn't alive", target)
+	}
+	switch {
+	case action == "kill" && g.roles[p] == werewolf:
+		if g.roles[target] == werewolf {
+			return errors.New("you can't kill a werewolf")
+		}
+		g.kills[p] = target
+		for _, wolf := range g.living(werewolf) {
+			t.Tell(wolf, fmt.Sprintf("%s wants to kill %s", p, target))
+		}
+	case action == "see" && g.roles[p] == seer:
+		if g.seen {
+			return errors.New("you have already looked tonight")
+		}
+		if target == p {
+			return errors.New("you already know what you are")
+		}
+		g.seen = true
+		if g.roles[target] == werewolf {
+			t.Tell(p, fmt.Sprintf("%s is a werewolf!", target))
+		} else {
+			t.Tell(p, fmt.Sprintf("%s is not a werewolf", target))
+		}
+	case action == "save" && g.roles[p] == doctor:
+		if g.saving != "" {
+			return fmt.Errorf("you are already protecting %s tonight", g.saving)
+		}
+		g.saving = target
+		t.Tell(p, fmt.Sprintf("you will protect %s tonight", target))
+	default:
+		return errors.New("you can't do that")
+	}
+	if g.nightOver() {
+		g.dawn(t)
+	}
+	return nil
+}
+
+// nightOver reports whether everyone has taken their night action.
+func (g *Game) nightOver() bool {
+	for _, wolf := range g.living(werewolf) {
+		if _, ok := g.kills[wolf]; !ok {
+			return false
+		}
+	}
+	if len(g.living(seer)) > 0 && !g.seen {
+		return false
+	}
+	if len(g.living(doctor)) > 0 && g.saving == "" {
+		return false
+	}
+	return true
+}
+
+// victim returns the player the most werewolves chose to kill.
+// Ties go to whoever is first in turn order.
+func (g *Game) victim() chat.Person {
+	count := make(map[chat.Person]int)
+	for _, target := range g.kills {
+		count[target]++
+	}
+	var victim chat.Person
+	for _, p := range g.living("") {
+		if count[p] > count[victim] {
+			victim = p
+		}
+	}
+	return victim
+}
+
+// dawn ends the night and reveals what happened.
+func (g *Game) dawn(t *games.Table) {
+	victim := g.victim()
+	switch {
+	case victim == "":
+		t.Announce("the sun rises. nobody died in the night")
+	case victim == g.saving:
+		t.Announce("the sun rises. the werewolves attacked, but the doctor saved their victim!")
+	default:
+		t.Announce(fmt.Sprintf("the sun rises. %s was killed in the night; they were a %s", victim, g.roles[victim]))
+		g.die(t, victim)
+	}
+	if g.checkWin(t) {
+		return
+	}
+	g.day(t)
+}
+
+func (g *Game) die(t *games.Table, p chat.Person) {
+	g.alive[p] = false
+	delete(g.kills, p)
+	delete(g.votes, p)
+	for voter, q := range g.votes {
+		if q == p {
+			delete(g.votes, voter)
+		}
+	}
+	t.Tell(p, "You are dead. Please don't talk about the game until it's over.")
+}
+
+// day starts the day's discussion and vote.
+func (g *Game) day(t *games.Table) {
+	g.votes = make(map[chat.Person]chat.Person)
+	t.SetPhase("day", g.dayTime())
+	t.Announce(fmt.Sprintf("day %d: who is a werewolf? say \"magicalbot: werewolf vote [nick]\"; %d votes will lynch someone",
+		g.round, g.majority()))
+}
+
+func (g *Game) majority() int {
+	return len(g.living(""))/2 + 1
+}
+
+// vote records p's vote to lynch target.
+// As soon as a majority agree, target is lynched.
+func (g *Game) vote(t *games.Table, p, target chat.Person) error {
+	if t.Phase() != "day" {
+		return errors.New("you can only vote during the day")
+	}
+	if !g.alive[target] {
+		return fmt.Errorf("%s isn't alive", target)
+	}
+	g.votes[p] = target
+	n := g.tally()[target]
+	t.Announce(fmt.Sprintf("%s votes for %s (%d/%d)", p, target, n, g.majority()))
+	if n >= g.majority() {
+		g.lynch(t, target)
+	}
+	return nil
+}
+
+func (g *Game) tally() map[chat.Person]int {
+	count := make(map[chat.Person]int)
+	for _, target := range g.votes {
+		count[target]++
+	}
+	return count
+}
+
+// lynch kills p at the end of the day.
+func (g *Game) lynch(t *games.Table, p chat.Person) {
+	t.Announce(fmt.Sprintf("the village has lynched %s, who was a %s", p, g.roles[p]))
+	g.die(t, p)
+	if g.checkWin(t) {
+		return
+	}
+	g.night(t)
+}
+
+// checkWin ends the game if either side has won.
+func (g *Game) checkWin(t *games.Table) bool {
+	wolves := len(g.living(werewolf))
+	others := len(g.living("")) - wolves
+	switch {
+	case wolves == 0:
+		t.Announce("all the werewolves are dead. the villagers win!")
+	case wolves >= others:
+		t.Announce("the werewolves outnumber the villagers. the werewolves win!")
+	default:
+		return false
+	}
+	t.End()
+	return true
+}
+
+// Timeout implements games.Rules. When the night runs out,
+// whatever actions were taken happen; when the day runs out,
+// whoever has the most votes is lynched, unless there is a tie.
+func (g *Game) Timeout(t *games.Table, phase string) {
+	switch phase {
+	case "night":
+		g.dawn(t)
+	case "day":
+		count := g.tally()
+		var top []chat.Person
+		for _, p := range g.living("") {
+			switch {
+			case count[p] == 0:
+			case len(top) == 0 || count[p] > count[top[0]]:
+				top = []chat.Person{p}
+			case count[p] == count[top[0]]:
+				top = append(top, p)
+			}
+		}
+		if len(top) == 1 {
+			t.Announce("time's up!")
+			g.lynch(t, top[0])
+			return
+		}
+		t.Announce("time's up! the village couldn't decide, so nobody was lynched")
+		g.night(t)
+	}
+}
+
+// Leave implements games.Rules. Someone who leaves is as good as dead.
+func (g *Game) Leave(t *games.Table, p chat.Person) {
+	if !g.alive[p] {
+		return
+	}
+	t.Announce(fmt.Sprintf("%s was a %s", p, g.roles[p]))
+	g.die(t, p)
+	delete(g.alive, p)
+	if g.checkWin(t) {
+		return
+	}
+	if t.Phase() == "night" && g.nightOver() {
+		g.dawn(t)
+	}
+}
+
+// Stop implements games.Rules. It reveals everyone's role.
+func (g *Game) Stop(t *games.Table) {
+	// include anyone who left
+	var people []string
+	for p := range g.roles {
+		people = append(people, string(p))
+	}
+	sort.Strings(people)
+	var roles []string
+	for _, p := range people {
+		roles = append(roles, fmt.Sprintf("%s was a %s", p, g.roles[chat.Person(p)]))
+	}
+	if len(roles) > 0 {
+		t.Announce(strings.Join(roles, ", "))
+	}
+	g.roles = nil
+	g.alive = nil
+	g.kills = nil
+	g.votes = nil
+}
+
+// Status implements games.Rules.
+func (g *Game) Status(t *games.Table) string {
+	if t.Phase() == "night" {
+		return fmt.Sprintf("night %d; %d alive", g.round, len(g.living("")))
+	}
+	count := g.tally()
+	var targets []chat.Person
+	for p := range count {
+		targets = append(targets, p)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if count[targets[i]] != count[targets[j]] {
+			return count[targets[i]] > count[targets[j]]
+		}
+		return targets[i] < targets[j]
+	})
+	var votes []string
+	for _, p := range targets {
+		votes = append(votes, fmt.Sprintf("%s %d", p, count[p]))
+	}
+	if len(votes) == 0 {
+		votes = []string{"none"}
+	}
+	return fmt.Sprintf("day %d; %d alive; votes: %s", g.round, len(g.living("")), strings.Join(votes, ", "))
+}
+
+// Resume implements games.Rules.
+func (g *Game) Resume(t *games.Table) {
+	t.Announce(g.Status(t))
+}
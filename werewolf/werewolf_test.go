@@ -0,0 +1,204 @@
+package werewolf
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/magical/chat"
+	"github.com/magical/chat/games"
+	"github.com/magical/chat/internal/chattest"
+)
+
+func TestDeal(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := minPlayers; n <= maxPlayers; n++ {
+		count := make(map[role]int)
+		for _, r := range deal(r, n) {
+			count[r]++
+		}
+		if want := n / 4; count[werewolf] != want {
+			t.Errorf("%d players: %d werewolves, want %d", n, count[werewolf], want)
+		}
+		if count[seer] != 1 {
+			t.Errorf("%d players: %d seers, want 1", n, count[seer])
+		}
+		if hasDoctor := count[doctor] == 1; hasDoctor != (n >= 7) {
+			t.Errorf("%d players: %d doctors", n, count[doctor])
+		}
+	}
+}
+
+type testGame struct {
+	*Game
+	b    *chat.Bot
+	conn *chattest.Conn
+}
+
+// say sends a command in the room.
+func (g *testGame) say(from chat.Person, text string) {
+	g.Event(g.b, &chat.Message{Conn: g.conn, From: from, Room: "#village", Text: "magicalbot: werewolf " + text})
+}
+
+// tell sends a command privately.
+func (g *testGame) tell(from chat.Person, text string) {
+	g.Event(g.b, &chat.Message{Conn: g.conn, From: from, Text: "werewolf " + text})
+}
+
+// with returns the first living player with role r.
+func (g *testGame) with(r role) chat.Person {
+	if people := g.living(r); len(people) > 0 {
+		return people[0]
+	}
+	return ""
+}
+
+var villagers = []chat.Person{"alice", "bob", "carol", "dave", "eve"}
+
+func startGame(t *testing.T, store games.Store) *testGame {
+	b, _ := chat.NewBot()
+	conn := new(chattest.Conn)
+	b.AddConn(conn)
+	g := &testGame{&Game{Store: store, Source: rand.NewSource(1)}, b, conn}
+	for _, p := range villagers {
+		g.say(p, "join")
+	}
+	g.say("alice", "start")
+	if g.Table().Phase() != "night" {
+		t.Fatalf("game didn't start: %q", conn.Sent)
+	}
+	for _, p := range villagers {
+		if !conn.Said(chat.Room(p), "You are") {
+			t.Errorf("%s wasn't told their role", p)
+		}
+	}
+	return g
+}
+
+func TestGame(t *testing.T) {
+	g := startGame(t, nil)
+	wolf, seer := g.with(werewolf), g.with(seer)
+	var victim, other chat.Person
+	for _, p := range g.living(villager) {
+		if victim == "" {
+			victim = p
+		} else if other == "" {
+			other = p
+		}
+	}
+
+	g.tell(victim, "kill "+string(seer))
+	if !g.conn.Said(chat.Room(victim), "you can't do that") {
+		t.Errorf("a villager tried to kill someone")
+	}
+	g.say(wolf, "kill "+string(victim))
+	if !g.conn.Said(chat.Room(wolf), "do that privately") {
+		t.Errorf("the wolf was allowed to kill in public")
+	}
+	g.tell(seer, "see "+string(wolf))
+	if !g.conn.Said(chat.Room(seer), string(wolf)+" is a werewolf!") {
+		t.Errorf("the seer didn't see the werewolf: %q", g.conn.Sent)
+	}
+	g.tell(wolf, "kill "+string(victim))
+	if g.Table().Phase() != "day" || g.alive[victim] {
+		t.Fatalf("after everyone acted: phase = %q, %s alive = %v", g.Table().Phase(), victim, g.alive[victim])
+	}
+	if !g.conn.Said("#village", string(victim)+" was killed in the night") {
+		t.Errorf("the death wasn't announced: %q", g.conn.Sent)
+	}
+
+	g.say(victim, "vote "+string(wolf))
+	if !g.conn.Said(chat.Room(victim), "you're dead") {
+		t.Errorf("a dead player voted")
+	}
+	// four players left, so three votes are needed
+	g.say(seer, "vote "+string(wolf))
+	g.say(other, "vote "+string(wolf))
+	if !g.alive[wolf] {
+		t.Fatalf("lynched with only two votes")
+	}
+	g.say(wolf, "vote "+string(seer))
+	for _, p := range g.living("") {
+		if p != wolf && p != seer && p != other {
+			g.say(p, "vote "+string(wolf))
+		}
+	}
+	if g.Table().Phase() != "" || !g.conn.Said("#village", "the villagers win!") {
+		t.Errorf("the werewolf was lynched, but the villagers didn't win: %q", g.conn.Sent)
+	}
+	if !g.conn.Said("#village", string(wolf)+" was a werewolf") {
+		t.Errorf("roles weren't revealed at the end: %q", g.conn.Sent)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	store := games.FileStore(filepath.Join(t.TempDir(), "werewolf.json"))
+	g := startGame(t, store)
+
+	// nobody acts at night
+	g.Table().Expire()
+	if g.Table().Phase() != "day" || !g.conn.Said("#village", "nobody died") {
+		t.Fatalf("night didn't end when time ran out: %q", g.conn.Sent)
+	}
+
+	// a tied vote lynches nobody
+	living := g.living("")
+	g.say(living[0], "vote "+string(living[1]))
+	g.say(living[1], "vote "+string(living[0]))
+	g.Table().Expire()
+	if g.Table().Phase() != "night" || len(g.living("")) != 5 {
+		t.Fatalf("tied vote: phase = %q, %d alive", g.Table().Phase(), len(g.living("")))
+	}
+
+	// the game survives a restart
+	h := &testGame{&Game{Store: store}, g.b, g.conn}
+	if err := h.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if h.round != 2 || h.Table().Phase() != "night" || h.roles[living[0]] != g.roles[living[0]] {
+		t.Errorf("restored round %d, phase %q", h.round, h.Table().Phase())
+	}
+
+	// a lone vote wins when time runs out
+	h.Table().Expire()
+	wolf := h.with(werewolf)
+	var target chat.Person
+	for _, p := range h.living(villager) {
+		target = p
+	}
+	h.say(wolf, "vote "+string(target))
+	h.Table().Expire()
+	if h.alive[target] || !h.conn.Said("#village", "the village has lynched "+string(target)) {
+		t.Errorf("%s wasn't lynched: %q", target, h.conn.Sent)
+	}
+}
+
+func TestLeave(t *testing.T) {
+	g := startGame(t, nil)
+	wolf := g.with(werewolf)
+	g.say(wolf, "leave")
+	if g.Table().Phase() != "" {
+		t.Errorf("the only werewolf left, but the game didn't end")
+	}
+	if !g.conn.Said("#village", string(wolf)+" was a werewolf") {
+		t.Errorf("the werewolf's role wasn't revealed: %q", g.conn.Sent)
+	}
+}
+
+func TestDeadLeave(t *testing.T) {
+	g := startGame(t, nil)
+	wolf := g.with(werewolf)
+	victim := g.with(villager)
+	g.tell(wolf, "kill "+string(victim))
+	g.Table().Expire()
+	if g.alive[victim] {
+		t.Fatalf("%s wasn't killed: %q", victim, g.conn.Sent)
+	}
+	g.say(victim, "leave")
+	if g.Table().Phase() != "day" {
+		t.Errorf("a dead player left, and the phase became %q", g.Table().Phase())
+	}
+	if g.conn.Said("#village", string(wolf)+" was a werewolf") {
+		t.Errorf("roles were revealed when a dead player left: %q", g.conn.Sent)
+	}
+}